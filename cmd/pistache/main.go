@@ -2,19 +2,52 @@
 package main
 
 import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	"github.com/mfamador/pistache/internal/config"
 	_ "github.com/mfamador/pistache/internal/logger"
 	"github.com/mfamador/pistache/internal/server"
+	"github.com/mfamador/pistache/internal/tracing"
 
 	"github.com/rs/zerolog/log"
 )
 
+const tracingShutdownTimeout = 5 * time.Second
+
 func main() {
 	log.Info().Msg("Starting Pistache")
 
+	stopTracing, err := tracing.Start(config.Config.Tracing)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to start tracing")
+	}
+
+	// Shut down gracefully on the first signal, a second one kills the process
+	ctx, stop := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-signals
+		log.Info().Str("signal", sig.String()).Msg("Received signal")
+		signal.Reset(syscall.SIGTERM, os.Interrupt)
+		stop()
+	}()
+
 	// Start handling requests
-	err := server.Start(config.Config.Server, &config.Config.Services)
+	err = server.Start(ctx, config.Config.Server, &config.Config.Services)
+	stop()
+
+	flushCtx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+	if stopErr := stopTracing(flushCtx); stopErr != nil {
+		log.Error().Err(stopErr).Msg("Failed to flush the spans")
+	}
+	cancel()
+
 	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to start the HTTP server")
+		log.Fatal().Err(err).Msg("HTTP server failed")
 	}
 }
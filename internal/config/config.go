@@ -10,6 +10,7 @@ import (
 	"github.com/jinzhu/configor"
 	"github.com/mfamador/pistache/internal/server"
 	"github.com/mfamador/pistache/internal/services"
+	"github.com/mfamador/pistache/internal/tracing"
 )
 
 // LoggerConfig has the log level and if we should pretty print
@@ -24,6 +25,8 @@ type appConfig struct {
 	Server        server.Config   `yaml:"server"`
 	DeploymentEnv string          `yaml:"deploymentEnv" env:"DEPLOYMENT_ENV" default:"unset"`
 	Services      services.Config `yaml:"services"`
+	// Tracing exports OpenTelemetry spans. Set to nil to disable the export
+	Tracing *tracing.Config `yaml:"tracing"`
 }
 
 var (
@@ -0,0 +1,96 @@
+// Package caches for the caches implementation
+package caches
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mfamador/pistache/internal/models"
+	"github.com/mfamador/pistache/internal/repos"
+)
+
+// keyIndex keeps the keys of the in-memory cache, which can't list them.
+// The cache only gives back the evicted values, so the index maps them to
+// their keys too
+type keyIndex struct {
+	mu      sync.RWMutex
+	entries map[string]*models.Response
+	keyOf   map[*models.Response]string
+}
+
+func newKeyIndex() *keyIndex {
+	return &keyIndex{
+		entries: make(map[string]*models.Response),
+		keyOf:   make(map[*models.Response]string),
+	}
+}
+
+func (x *keyIndex) add(key string, resp *models.Response) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if old, ok := x.entries[key]; ok {
+		// The cache replaced it without evicting it
+		delete(x.keyOf, old)
+	}
+	x.entries[key] = resp
+	x.keyOf[resp] = key
+}
+
+func (x *keyIndex) remove(resp *models.Response) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	key, ok := x.keyOf[resp]
+	if !ok {
+		return
+	}
+	delete(x.keyOf, resp)
+	if x.entries[key] == resp {
+		delete(x.entries, key)
+	}
+}
+
+// keys returns the live keys starting with prefix, in order, after the
+// cursor, which is the last key of the previous page
+func (x *keyIndex) keys(prefix, cursor string, count int, now time.Time) ([]string, string) {
+	x.mu.RLock()
+	matching := make([]string, 0, len(x.entries))
+	for k, resp := range x.entries {
+		if strings.HasPrefix(k, prefix) && k > cursor && live(resp, now) {
+			matching = append(matching, k)
+		}
+	}
+	x.mu.RUnlock()
+
+	sort.Strings(matching)
+	if len(matching) <= count {
+		return matching, ""
+	}
+
+	page := matching[:count]
+	return page, page[count-1]
+}
+
+func (x *keyIndex) stats(now time.Time) repos.CacheStats {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	var stats repos.CacheStats
+	for _, resp := range x.entries {
+		if live(resp, now) {
+			stats.Entries++
+			stats.Bytes += int64(len(resp.Body))
+		}
+	}
+
+	return stats
+}
+
+// live tells if an entry isn't expired yet. The cache removes the expired
+// entries periodically
+func live(resp *models.Response, now time.Time) bool {
+	return resp.ExpiresAt.IsZero() || now.Before(resp.ExpiresAt)
+}
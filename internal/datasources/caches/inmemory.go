@@ -2,18 +2,48 @@
 package caches
 
 import (
+	"context"
+	"sync/atomic"
 	"time"
 
 	"github.com/dgraph-io/ristretto"
 	"github.com/mfamador/pistache/internal/models"
 	"github.com/mfamador/pistache/internal/repos"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
+// inMemoryMetrics holds the *ristretto.Metrics of the last in-memory cache
+// created, the one the app uses
+var inMemoryMetrics atomic.Value
+
+var (
+	_ = promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "pistache_cache_memory_evictions_total",
+		Help: "Number of entries evicted from the in-memory cache to make room",
+	}, func() float64 {
+		return float64(loadInMemoryMetrics().KeysEvicted())
+	})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "pistache_cache_memory_cost",
+		Help: "Cost used by the entries of the in-memory cache",
+	}, func() float64 {
+		m := loadInMemoryMetrics()
+		return float64(m.CostAdded()) - float64(m.CostEvicted())
+	})
+)
+
+func loadInMemoryMetrics() *ristretto.Metrics {
+	m, _ := inMemoryMetrics.Load().(*ristretto.Metrics)
+	return m
+}
+
 type inMemory struct {
 	cache *ristretto.Cache
+	index *keyIndex
 }
 
-func (i inMemory) Fetch(s string) (*models.Response, error) {
+func (i inMemory) Fetch(_ context.Context, s string) (*models.Response, error) {
 	value, found := i.cache.Get(s)
 	if !found {
 		return nil, nil
@@ -24,23 +54,57 @@ func (i inMemory) Fetch(s string) (*models.Response, error) {
 	return resp, nil
 }
 
-func (i inMemory) Store(s string, response *models.Response, ttl time.Duration) bool {
-	return i.cache.SetWithTTL(s, response, 1, ttl)
+func (i inMemory) Store(_ context.Context, s string, response *models.Response, ttl time.Duration) bool {
+	if !i.cache.SetWithTTL(s, response, 1, ttl) {
+		return false
+	}
+	i.index.add(s, response)
+
+	return true
+}
+
+func (i inMemory) Keys(prefix, cursor string, count int) ([]string, string, error) {
+	keys, next := i.index.keys(prefix, cursor, count, time.Now())
+	return keys, next, nil
+}
+
+func (i inMemory) Stats() (repos.CacheStats, error) {
+	return i.index.stats(time.Now()), nil
+}
+
+func (i inMemory) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Close leaves the memory to be released with the process. Closing ristretto
+// would make the writes still in flight panic
+func (i inMemory) Close() error {
+	return nil
 }
 
 // NewInMemory handles in memory cache
 func NewInMemory() (repos.Cache, error) {
+	index := newKeyIndex()
 	cache, err := ristretto.NewCache(&ristretto.Config{
 		NumCounters: 1e7,     // number of keys to track frequency of (10M).
 		MaxCost:     1 << 30, // maximum cost of cache (1GB).
 		BufferItems: 64,      // number of keys per Get buffer.
+		Metrics:     true,
+		// Evicted and expired entries leave the index
+		OnEvict: func(_, _ uint64, value interface{}, _ int64) {
+			if resp, ok := value.(*models.Response); ok {
+				index.remove(resp)
+			}
+		},
 	})
 
 	if err != nil {
 		return nil, err
 	}
+	inMemoryMetrics.Store(cache.Metrics)
 
 	return &inMemory{
 		cache: cache,
+		index: index,
 	}, nil
 }
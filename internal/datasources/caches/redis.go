@@ -5,15 +5,27 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/rs/zerolog/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/mfamador/pistache/internal/models"
 	"github.com/mfamador/pistache/internal/repos"
+	"github.com/mfamador/pistache/internal/requestid"
 )
 
+var redisDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name: "pistache_cache_redis_duration_seconds",
+	Help: "Latency of Redis operations",
+}, []string{"operation"})
+
 // RedisConfig contains the config options for a REDIS cluster server
 type RedisConfig struct {
 	Servers []struct {
@@ -26,25 +38,33 @@ type redisc struct {
 	cache *redis.ClusterClient
 }
 
-func (i redisc) Fetch(s string) (*models.Response, error) {
-	value, err := i.cache.Get(context.Background(), s).Result()
-	if err != nil && err != redis.Nil {
+func (i redisc) Fetch(ctx context.Context, s string) (*models.Response, error) {
+	start := time.Now()
+	value, err := i.cache.Get(ctx, s).Result()
+	redisDuration.WithLabelValues("fetch").Observe(time.Since(start).Seconds())
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
 		return nil, err
 	}
 
 	resp := models.Response{}
 	if err := json.Unmarshal([]byte(value), &resp); err != nil {
-		log.Warn().Err(err).Msg("Failed to get unmarshal response")
+		requestid.Logger(ctx).Warn().Err(err).Msg("Failed to get unmarshal response")
 		return nil, err
 	}
 
 	return &resp, nil
 }
 
-func (i redisc) Store(s string, response *models.Response, ttl time.Duration) bool {
+func (i redisc) Store(ctx context.Context, s string, response *models.Response, ttl time.Duration) bool {
+	start := time.Now()
+	// The request may be over by the time its response is stored
 	res := i.cache.Set(context.Background(), s, response, ttl)
+	redisDuration.WithLabelValues("store").Observe(time.Since(start).Seconds())
 	if res.Err() != nil {
-		log.Warn().
+		requestid.Logger(ctx).Warn().
 			Interface("response", response).
 			Err(res.Err()).Msg("Failed to store response in REDIS")
 		return false
@@ -53,6 +73,123 @@ func (i redisc) Store(s string, response *models.Response, ttl time.Duration) bo
 	return true
 }
 
+// Keys scans the masters one after the other. The cursor is the address of
+// the master being scanned and its own cursor. A page can be empty while
+// the cursor isn't
+func (i redisc) Keys(prefix, cursor string, count int) ([]string, string, error) {
+	ctx := context.Background()
+	masters, err := i.masters(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	addrs := make([]string, 0, len(masters))
+	for addr := range masters {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	if len(addrs) == 0 {
+		return nil, "", nil
+	}
+
+	addr, pos := addrs[0], uint64(0)
+	if cursor != "" {
+		sep := strings.LastIndex(cursor, "/")
+		if sep < 0 {
+			return nil, "", fmt.Errorf("invalid cursor %q", cursor)
+		}
+		if pos, err = strconv.ParseUint(cursor[sep+1:], 10, 64); err != nil {
+			return nil, "", fmt.Errorf("invalid cursor %q", cursor)
+		}
+		if addr = cursor[:sep]; masters[addr] == nil {
+			return nil, "", fmt.Errorf("unknown node in cursor %q", cursor)
+		}
+	}
+
+	start := time.Now()
+	keys, next, err := masters[addr].Scan(ctx, pos, globEscaper.Replace(prefix)+"*", int64(count)).Result()
+	redisDuration.WithLabelValues("scan").Observe(time.Since(start).Seconds())
+	if err != nil {
+		return nil, "", err
+	}
+
+	if next != 0 {
+		return keys, fmt.Sprintf("%s/%d", addr, next), nil
+	}
+
+	// Carry on with the next master
+	n := sort.SearchStrings(addrs, addr) + 1
+	if n == len(addrs) {
+		return keys, "", nil
+	}
+
+	return keys, addrs[n] + "/0", nil
+}
+
+// Stats adds up the keys and the memory used by every master, including
+// the keys not stored by Pistache
+func (i redisc) Stats() (repos.CacheStats, error) {
+	var entries, bytes int64
+	err := i.cache.ForEachMaster(context.Background(), func(ctx context.Context, client *redis.Client) error {
+		n, err := client.DBSize(ctx).Result()
+		if err != nil {
+			return err
+		}
+		atomic.AddInt64(&entries, n)
+
+		info, err := client.Info(ctx, "memory").Result()
+		if err != nil {
+			return err
+		}
+		atomic.AddInt64(&bytes, usedMemory(info))
+
+		return nil
+	})
+
+	return repos.CacheStats{Entries: entries, Bytes: bytes}, err
+}
+
+func (i redisc) Ping(ctx context.Context) error {
+	start := time.Now()
+	err := i.cache.Ping(ctx).Err()
+	redisDuration.WithLabelValues("ping").Observe(time.Since(start).Seconds())
+
+	return err
+}
+
+func (i redisc) Close() error {
+	return i.cache.Close()
+}
+
+// masters returns the clients of the masters, by address
+func (i redisc) masters(ctx context.Context) (map[string]*redis.Client, error) {
+	var mu sync.Mutex
+	masters := make(map[string]*redis.Client)
+	err := i.cache.ForEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+		mu.Lock()
+		masters[client.Options().Addr] = client
+		mu.Unlock()
+		return nil
+	})
+
+	return masters, err
+}
+
+// globEscaper escapes the characters matching patterns in a SCAN
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// usedMemory reads the used_memory field of an INFO reply
+func usedMemory(info string) int64 {
+	for _, line := range strings.Split(info, "\r\n") {
+		if v := strings.TrimPrefix(line, "used_memory:"); v != line {
+			n, _ := strconv.ParseInt(v, 10, 64)
+			return n
+		}
+	}
+
+	return 0
+}
+
 // NewRedis handles cache supported in Redis
 func NewRedis(conf *RedisConfig) repos.Cache {
 	redisURLs := make([]string, len(conf.Servers))
@@ -2,27 +2,68 @@
 package handlers
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/labstack/echo/v4"
+	"github.com/mfamador/pistache/internal/models"
+	"github.com/mfamador/pistache/internal/requestid"
 	"github.com/mfamador/pistache/internal/services"
-	"github.com/rs/zerolog/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 const (
 	defaultContentType = "application/octet-stream"
 	pistacheHeader     = "X-Pistache"
-	statusSkipped      = "skipped"
-	statusCacheHit     = "hit"
-	statusCacheMiss    = "miss"
+	keyDebugHeader     = "X-Pistache-Key"
+	ageHeader          = "Age"
+	dateHeader         = "Date"
+	cacheStatusHeader  = "Cache-Status"
+	cacheStatusName    = "Pistache"
+	rangeHeader        = "Range"
+	ifRangeHeader      = "If-Range"
+)
+
+// Cache statuses of the requests
+const (
+	CacheStatusSkipped = "skipped"
+	CacheStatusHit     = "hit"
+	CacheStatusMiss    = "miss"
 )
 
+const (
+	// CacheStatusContextKey is where the handler stores the cache status of
+	// a request
+	CacheStatusContextKey = "cacheStatus"
+	// CacheTierContextKey is where the handler stores the tier of a hit
+	CacheTierContextKey = "cacheTier"
+)
+
+var cacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "pistache_cache_requests_total",
+	Help: "Number of requests by route and cache status (hit, miss or skipped), with the tier of hits",
+}, []string{"route", "status", "tier"})
+
 // Cache exposes the interface
 type Cache interface {
 	Handle(echo.Context) error
+	// Wait waits for the responses being stored in the background
+	Wait(context.Context) error
 }
 
 type cacheHandler struct {
 	cache services.Cache
 	proxy services.Proxy
+	// stores tracks the responses being stored in the background
+	stores sync.WaitGroup
 }
 
 // NewCache creates a new Cache handler
@@ -37,48 +78,215 @@ func (h *cacheHandler) Handle(ctx echo.Context) error {
 	// Set the value so we can log this later with the request
 	skip := h.cache.Skip(ctx.Request())
 	ctx.Set("pistached", !skip)
+	route := h.proxy.Route(ctx.Request())
 	if skip {
+		ctx.Set(CacheStatusContextKey, CacheStatusSkipped)
+		cacheRequests.WithLabelValues(route, CacheStatusSkipped, "").Inc()
 		// Set the header, so our clients can know they've been pistached
-		ctx.Response().Header().Set(pistacheHeader, statusSkipped)
-		if _, err := h.proxy.Request(ctx); err != nil {
-			log.Debug().Err(err).Msg("Failed to process request")
-		}
-		// The proxy service request will handle the HTTP flow for us
-		// There is no need to return the error
-		return nil
+		ctx.Response().Header().Set(pistacheHeader, CacheStatusSkipped)
+		appendCacheStatus(ctx, "fwd=bypass")
+		_, err := h.proxy.Request(ctx)
+
+		return proxyError(ctx, err)
 	}
 
+	keyDebug := h.cache.KeyDebug(ctx.Request())
 	key, cachedResponse, err := h.cache.GetCachedResponse(ctx.Request())
 	if err != nil {
-		log.Debug().Err(err).Msg("Failed to cache request")
+		requestid.Logger(ctx.Request().Context()).Debug().Err(err).Msg("Failed to cache request")
+	}
+	if keyDebug {
+		h.explainKey(ctx)
 	}
+	// Let the proxy balance on the key
+	ctx.Set(services.CacheKeyContextKey, key)
 
 	if cachedResponse != nil {
-		// Set the cached headers
-		for k, v := range cachedResponse.Header {
-			ctx.Response().Header().Set(k, v[0])
-		}
+		ctx.Set(CacheStatusContextKey, CacheStatusHit)
+		ctx.Set(CacheTierContextKey, cachedResponse.Tier)
+		cacheRequests.WithLabelValues(route, CacheStatusHit, cachedResponse.Tier).Inc()
+		requestid.Logger(ctx.Request().Context()).Debug().
+			Str("key", key).
+			Str("origin_request_id", cachedResponse.RequestID).
+			Msg("Serving cached response")
+		return h.respondFromCache(ctx, cachedResponse)
+	}
+	ctx.Set(CacheStatusContextKey, CacheStatusMiss)
+	cacheRequests.WithLabelValues(route, CacheStatusMiss, "").Inc()
 
-		// Set the header, so our clients can know they've been pistached
-		ctx.Response().Header().Set(pistacheHeader, statusCacheHit)
+	// A range of a cacheable response is answered from the full response,
+	// fetched without the range so it can be stored
+	req := ctx.Request()
+	fullForRange := req.Method == http.MethodGet && key != "" && req.Header.Get(rangeHeader) != ""
+	if fullForRange {
+		fullReq := req.Clone(req.Context())
+		fullReq.Header.Del(rangeHeader)
+		fullReq.Header.Del(ifRangeHeader)
+		ctx.SetRequest(fullReq)
+		ctx.Set(services.HoldContextKey, true)
+	}
 
-		// return cached response
-		return ctx.Blob(
-			cachedResponse.StatusCode,
-			extractContentType(cachedResponse.Header),
-			cachedResponse.Body,
-		)
+	if req.Method == http.MethodHead {
+		if h.cache.FetchHeadWithGet() {
+			// The server still knows it's a HEAD request and won't send the body
+			getReq := req.Clone(req.Context())
+			getReq.Method = http.MethodGet
+			ctx.SetRequest(getReq)
+			defer ctx.SetRequest(req)
+		} else {
+			// A HEAD response has no body, so it can't be stored as the GET entry
+			key = ""
+		}
 	}
 
 	// Set the header, so our clients can know they've been pistached
-	ctx.Response().Header().Set(pistacheHeader, statusCacheMiss)
+	ctx.Response().Header().Set(pistacheHeader, CacheStatusMiss)
+	appendCacheStatus(ctx, "fwd=uri-miss")
 	response, err := h.proxy.Request(ctx)
+	if fullForRange {
+		ctx.SetRequest(req)
+	}
+
+	// Streamed responses aren't returned, they can't be stored
+	if err == nil && key != "" && response != nil {
+		// The echo context is reused once the handler returns
+		reqCtx := ctx.Request().Context()
+		h.stores.Add(1)
+		go func() {
+			defer h.stores.Done()
+			h.cache.Store(reqCtx, key, response)
+		}()
+	}
 
-	if err == nil && key != "" {
-		go h.cache.Store(key, response)
+	// The proxy held the full response back, unless it couldn't be cached
+	if err == nil && fullForRange && response != nil && !ctx.Response().Committed {
+		serveRange(ctx, response)
+		return nil
+	}
+
+	return proxyError(ctx, err)
+}
+
+// Wait waits for the responses being stored in the background, or until the
+// context is done
+func (h *cacheHandler) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		h.stores.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// explainKey sets the explanation of the key of the request in a response
+// header
+func (h *cacheHandler) explainKey(ctx echo.Context) {
+	e, err := h.cache.ExplainKey(ctx.Request())
+	if err == nil {
+		var b []byte
+		if b, err = json.Marshal(e); err == nil {
+			ctx.Response().Header().Set(keyDebugHeader, string(b))
+			return
+		}
 	}
 
-	return nil
+	requestid.Logger(ctx.Request().Context()).Warn().Err(err).Msg("Failed to explain the key")
+}
+
+// proxyError returns the error of a proxied request if no response was sent
+// yet, so the client gets an error response instead of an empty one
+func proxyError(ctx echo.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	requestid.Logger(ctx.Request().Context()).Debug().Err(err).Msg("Failed to process request")
+	if ctx.Response().Committed {
+		return nil
+	}
+
+	return err
+}
+
+// respondFromCache replays a cached response, serving the requested ranges of
+// a full cached response if there are any
+func (h *cacheHandler) respondFromCache(ctx echo.Context, cachedResponse *models.Response) error {
+	// Set the cached headers
+	header := ctx.Response().Header()
+	for k, v := range cachedResponse.Header {
+		header[k] = append([]string(nil), v...)
+	}
+	services.RemoveHopByHopHeaders(header)
+
+	now := time.Now()
+	header.Set(dateHeader, now.UTC().Format(http.TimeFormat))
+	header.Set(ageHeader, strconv.FormatInt(int64(cachedResponse.Age(now)/time.Second), 10))
+
+	// Set the header, so our clients can know they've been pistached
+	header.Set(pistacheHeader, CacheStatusHit)
+	params := []string{CacheStatusHit}
+	if !cachedResponse.ExpiresAt.IsZero() {
+		params = append(params, fmt.Sprintf("ttl=%d", int64(cachedResponse.TTL(now)/time.Second)))
+	}
+	if cachedResponse.Tier != "" {
+		params = append(params, fmt.Sprintf("detail=%s", cachedResponse.Tier))
+	}
+	header.Set(cacheStatusHeader, cacheStatus(params...))
+
+	contentType := extractContentType(cachedResponse.Header)
+
+	req := ctx.Request()
+	if req.Header.Get(rangeHeader) != "" && cachedResponse.StatusCode == http.StatusOK {
+		serveRange(ctx, cachedResponse)
+		return nil
+	}
+
+	if req.Method == http.MethodHead {
+		// Same headers as the GET response, without the body
+		header.Set(echo.HeaderContentType, contentType)
+		header.Set(echo.HeaderContentLength, strconv.Itoa(len(cachedResponse.Body)))
+		return ctx.NoContent(cachedResponse.StatusCode)
+	}
+
+	// return cached response
+	return ctx.Blob(cachedResponse.StatusCode, contentType, cachedResponse.Body)
+}
+
+// serveRange answers a Range request from a full 200 response, whose headers
+// are already set. ServeContent handles single and multiple ranges, If-Range
+// and unsatisfiable ranges for us
+func serveRange(ctx echo.Context, response *models.Response) {
+	header := ctx.Response().Header()
+	header.Set(echo.HeaderContentType, extractContentType(response.Header))
+	// The length of the full response doesn't apply to the range
+	header.Del(echo.HeaderContentLength)
+	lastModified, _ := http.ParseTime(header.Get(echo.HeaderLastModified))
+	http.ServeContent(ctx.Response(), ctx.Request(), "", lastModified, bytes.NewReader(response.Body))
+}
+
+// appendCacheStatus adds our entry to the Cache-Status header of a forwarded
+// response once the upstream entries are copied, as we're the last cache to
+// handle it. A held response is written twice, the entry is only added once
+func appendCacheStatus(ctx echo.Context, params ...string) {
+	res := ctx.Response()
+	var added bool
+	res.Before(func() {
+		if !added {
+			res.Header().Add(cacheStatusHeader, cacheStatus(params...))
+			added = true
+		}
+	})
+}
+
+// cacheStatus formats a Cache-Status header value, as defined in RFC 9211
+func cacheStatus(params ...string) string {
+	return strings.Join(append([]string{cacheStatusName}, params...), "; ")
 }
 
 func extractContentType(headers map[string][]string) string {
@@ -1,9 +1,14 @@
 package handlers_test
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/mfamador/pistache/internal/handlers"
@@ -12,6 +17,7 @@ import (
 	"github.com/mfamador/pistache/internal/services"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog/log"
 )
 
@@ -36,7 +42,7 @@ func (cs *mockCacheService) Skip(req *http.Request) bool {
 }
 
 // Store stores a response
-func (cs *mockCacheService) Store(s string, resp *models.Response) bool {
+func (cs *mockCacheService) Store(ctx context.Context, s string, resp *models.Response) bool {
 	log.Info().
 		Str("key", s).
 		Interface("resp", resp).
@@ -45,12 +51,163 @@ func (cs *mockCacheService) Store(s string, resp *models.Response) bool {
 	return true
 }
 
+// FetchHeadWithGet tells if HEAD requests are fetched with GET
+func (cs *mockCacheService) FetchHeadWithGet() bool {
+	return false
+}
+
+// ExplainKey explains the key of a request
+func (cs *mockCacheService) ExplainKey(req *http.Request) (*services.KeyExplanation, error) {
+	return &services.KeyExplanation{
+		URL:       req.URL.String(),
+		Canonical: req.Method + req.Host,
+		Key:       "{test}-key-",
+		Tiers:     []services.TierPresence{{Tier: services.TierMemory}},
+	}, nil
+}
+
+// KeyDebug tells if a request asks for its key
+func (cs *mockCacheService) KeyDebug(req *http.Request) bool {
+	return req.Header.Get("X-Pistache-Debug") == "secret"
+}
+
+// Keys lists the keys of a tier
+func (cs *mockCacheService) Keys(tier, prefix, cursor string, count int) (*services.KeyPage, error) {
+	if tier != services.TierMemory {
+		return nil, fmt.Errorf("%w: %s", services.ErrUnknownTier, tier)
+	}
+
+	return &services.KeyPage{Keys: []string{prefix + "key-"}, Cursor: fmt.Sprintf("%s%d", cursor, count)}, nil
+}
+
+// Entry describes a cached response
+func (cs *mockCacheService) Entry(key string) (*services.Entry, error) {
+	if key != "{test}-key-" {
+		return nil, nil
+	}
+
+	return &services.Entry{
+		Key:        key,
+		StatusCode: http.StatusOK,
+		Header:     map[string][]string{"Content-Type": {"text/plain"}},
+		Size:       6,
+		Body:       []byte("cached"),
+	}, nil
+}
+
+// Stats describes the cache tiers
+func (cs *mockCacheService) Stats() *services.Stats {
+	return &services.Stats{Tiers: []services.TierStats{{Tier: services.TierMemory}}}
+}
+
+// Ping reaches the memory tier
+func (cs *mockCacheService) Ping(ctx context.Context) map[string]error {
+	return map[string]error{services.TierMemory: nil}
+}
+
+// Close closes the tiers
+func (cs *mockCacheService) Close() error {
+	return nil
+}
+
+type mockHitCacheService struct {
+	mockCacheService
+	response *models.Response
+}
+
+func (cs *mockHitCacheService) GetCachedResponse(req *http.Request) (string, *models.Response, error) {
+	return "key", cs.response, nil
+}
+
+func (cs *mockHitCacheService) Skip(req *http.Request) bool {
+	return false
+}
+
+type mockMissCacheService struct {
+	mockCacheService
+	stored chan *models.Response
+}
+
+func (cs *mockMissCacheService) GetCachedResponse(req *http.Request) (string, *models.Response, error) {
+	return "key", nil, nil
+}
+
+func (cs *mockMissCacheService) Skip(req *http.Request) bool {
+	return false
+}
+
+func (cs *mockMissCacheService) FetchHeadWithGet() bool {
+	return true
+}
+
+func (cs *mockMissCacheService) Store(ctx context.Context, s string, resp *models.Response) bool {
+	cs.stored <- resp
+	return true
+}
+
+type recordingProxyService struct {
+	mockProxyService
+	method string
+}
+
+func (ps *recordingProxyService) Request(c echo.Context) (*models.Response, error) {
+	ps.method = c.Request().Method
+	return &models.Response{StatusCode: http.StatusOK}, nil
+}
+
+type respondingProxyService struct {
+	mockProxyService
+}
+
+func (ps *respondingProxyService) Request(c echo.Context) (*models.Response, error) {
+	c.Response().Header().Add("Cache-Status", "Origin; hit")
+	return nil, c.NoContent(http.StatusOK)
+}
+
+type failingProxyService struct {
+	mockProxyService
+}
+
+func (ps *failingProxyService) Request(c echo.Context) (*models.Response, error) {
+	return nil, echo.NewHTTPError(http.StatusBadGateway, "upstream unreachable")
+}
+
+type timingOutProxyService struct {
+	mockProxyService
+}
+
+func (ps *timingOutProxyService) Request(c echo.Context) (*models.Response, error) {
+	return nil, fmt.Errorf("%w: localhost:8000", services.ErrUpstreamTimeout)
+}
+
+type unhealthyProxyService struct {
+	mockProxyService
+}
+
+func (ps *unhealthyProxyService) Upstreams() []services.UpstreamStatus {
+	return []services.UpstreamStatus{{Name: "localhost:8000", URL: "http://localhost:8000", Healthy: false}}
+}
+
 type mockProxyService struct{}
 
 func (ps *mockProxyService) Request(c echo.Context) (*models.Response, error) {
 	return nil, nil
 }
 
+func (ps *mockProxyService) Route(req *http.Request) string {
+	return services.DefaultPool
+}
+
+func (ps *mockProxyService) WarmedUp() bool {
+	return true
+}
+
+func (ps *mockProxyService) Stop() {}
+
+func (ps *mockProxyService) Upstreams() []services.UpstreamStatus {
+	return []services.UpstreamStatus{{Name: "localhost:8000", URL: "http://localhost:8000", Healthy: true}}
+}
+
 var _ = Describe("Cache handler", func() {
 	var (
 		w   *httptest.ResponseRecorder
@@ -62,7 +219,7 @@ var _ = Describe("Cache handler", func() {
 
 	BeforeEach(func() {
 		w = httptest.NewRecorder()
-		e, err = server.Setup()
+		e, err = server.Setup(server.Config{})
 		s = &mockCacheService{}
 		ps := &mockProxyService{}
 		h = handlers.NewCache(s, ps)
@@ -87,4 +244,306 @@ var _ = Describe("Cache handler", func() {
 			Bytes("body", body).
 			Msg("Response")
 	})
+
+	It("should replay a cached response", func() {
+		s = &mockHitCacheService{
+			response: &models.Response{
+				StatusCode: http.StatusOK,
+				Header: map[string][]string{
+					"Content-Type": {"text/plain"},
+					"Vary":         {"Accept", "Accept-Encoding"},
+					"Connection":   {"close"},
+				},
+				Body:      []byte("cached"),
+				StoredAt:  time.Now().Add(-10 * time.Second),
+				ExpiresAt: time.Now().Add(time.Hour),
+				Tier:      "redis",
+			},
+		}
+		h = handlers.NewCache(s, &mockProxyService{})
+
+		r, err := http.NewRequest("GET", "/", nil)
+		Expect(err).ToNot(HaveOccurred())
+		c := e.NewContext(r, w)
+
+		Expect(h.Handle(c)).To(Succeed())
+
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(w.Body.String()).To(Equal("cached"))
+		Expect(w.Header()["Vary"]).To(Equal([]string{"Accept", "Accept-Encoding"}))
+		Expect(w.Header()).ToNot(HaveKey("Connection"))
+		Expect(w.Header().Get("X-Pistache")).To(Equal("hit"))
+		Expect(w.Header().Get("Date")).ToNot(BeEmpty())
+
+		age, err := strconv.Atoi(w.Header().Get("Age"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(age).To(BeNumerically(">=", 10))
+
+		Expect(w.Header().Get("Cache-Status")).To(MatchRegexp(`^Pistache; hit; ttl=\d+; detail=redis$`))
+	})
+
+	Context("with a Range request", func() {
+		BeforeEach(func() {
+			s = &mockHitCacheService{
+				response: &models.Response{
+					StatusCode: http.StatusOK,
+					Header:     map[string][]string{"Content-Type": {"text/plain"}},
+					Body:       []byte("0123456789"),
+				},
+			}
+			h = handlers.NewCache(s, &mockProxyService{})
+		})
+
+		It("should serve a single range from the cached response", func() {
+			r, err := http.NewRequest("GET", "/", nil)
+			Expect(err).ToNot(HaveOccurred())
+			r.Header.Set("Range", "bytes=2-4")
+			c := e.NewContext(r, w)
+
+			Expect(h.Handle(c)).To(Succeed())
+
+			Expect(w.Code).To(Equal(http.StatusPartialContent))
+			Expect(w.Header().Get("Content-Range")).To(Equal("bytes 2-4/10"))
+			Expect(w.Body.String()).To(Equal("234"))
+		})
+
+		It("should serve multiple ranges as multipart/byteranges", func() {
+			r, err := http.NewRequest("GET", "/", nil)
+			Expect(err).ToNot(HaveOccurred())
+			r.Header.Set("Range", "bytes=0-1,8-9")
+			c := e.NewContext(r, w)
+
+			Expect(h.Handle(c)).To(Succeed())
+
+			Expect(w.Code).To(Equal(http.StatusPartialContent))
+			Expect(w.Header().Get("Content-Type")).To(HavePrefix("multipart/byteranges"))
+			Expect(w.Body.String()).To(ContainSubstring("01"))
+			Expect(w.Body.String()).To(ContainSubstring("89"))
+		})
+
+		It("should reject an unsatisfiable range", func() {
+			r, err := http.NewRequest("GET", "/", nil)
+			Expect(err).ToNot(HaveOccurred())
+			r.Header.Set("Range", "bytes=20-30")
+			c := e.NewContext(r, w)
+
+			Expect(h.Handle(c)).To(Succeed())
+
+			Expect(w.Code).To(Equal(http.StatusRequestedRangeNotSatisfiable))
+		})
+	})
+
+	Context("missing the cache", func() {
+		var (
+			upstream *httptest.Server
+			ranges   chan string
+		)
+
+		BeforeEach(func() {
+			ranges = make(chan string, 2)
+			upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ranges <- r.Header.Get("Range")
+				w.Header().Set("Content-Type", "text/plain")
+				w.Header().Set("Cache-Status", "Origin; hit")
+				_, _ = w.Write([]byte("0123456789"))
+			}))
+			u, err := url.Parse(upstream.URL)
+			Expect(err).ToNot(HaveOccurred())
+			port, err := strconv.Atoi(u.Port())
+			Expect(err).ToNot(HaveOccurred())
+
+			p, err := services.NewProxy(services.ProxyConfig{PoolConfig: services.PoolConfig{
+				Upstreams: []services.Upstream{{Host: u.Hostname(), Port: port}},
+			}})
+			Expect(err).ToNot(HaveOccurred())
+			conf := &services.CacheConfig{Methods: []string{http.MethodGet}}
+			conf.TTL.Success = 60
+			conf.Hash.Prefix = "miss"
+			conf.KeyDebug.Secret = "secret"
+			s, err = services.NewCache(conf)
+			Expect(err).ToNot(HaveOccurred())
+			h = handlers.NewCache(s, p)
+		})
+
+		AfterEach(func() {
+			upstream.Close()
+		})
+
+		request := func(header, value string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/file", nil)
+			if header != "" {
+				r.Header.Set(header, value)
+			}
+			Expect(h.Handle(e.NewContext(r, w))).To(Succeed())
+			return w
+		}
+
+		// waitForEntry waits for the response being stored in the background.
+		// The memory tier applies the writes asynchronously
+		waitForEntry := func() {
+			Expect(h.Wait(context.Background())).To(Succeed())
+			Eventually(func() *models.Response {
+				_, response, _ := s.GetCachedResponse(httptest.NewRequest(http.MethodGet, "/file", nil))
+				return response
+			}).ShouldNot(BeNil())
+		}
+
+		It("should store the full response and answer the next ranges from it", func() {
+			w := request("Range", "bytes=2-4")
+
+			Expect(w.Code).To(Equal(http.StatusPartialContent))
+			Expect(w.Header().Get("Content-Range")).To(Equal("bytes 2-4/10"))
+			Expect(w.Body.String()).To(Equal("234"))
+			Expect(w.Header().Values("Cache-Status")).To(Equal([]string{"Origin; hit", "Pistache; fwd=uri-miss"}))
+			Expect(ranges).To(Receive(BeEmpty()))
+			waitForEntry()
+
+			w = request("Range", "bytes=6-")
+
+			Expect(w.Code).To(Equal(http.StatusPartialContent))
+			Expect(w.Header().Get("Content-Range")).To(Equal("bytes 6-9/10"))
+			Expect(w.Header().Get("X-Pistache")).To(Equal(handlers.CacheStatusHit))
+			Expect(w.Body.String()).To(Equal("6789"))
+			Expect(ranges).ToNot(Receive())
+		})
+
+		It("should add its Cache-Status entry after the upstream ones", func() {
+			w := request("", "")
+
+			Expect(w.Header().Values("Cache-Status")).To(Equal([]string{"Origin; hit", "Pistache; fwd=uri-miss"}))
+		})
+
+		It("should not store the explanation of the key of a debug request", func() {
+			w := request("X-Pistache-Debug", "secret")
+
+			Expect(w.Header().Get("X-Pistache")).To(Equal(handlers.CacheStatusMiss))
+			Expect(w.Header().Get("X-Pistache-Key")).ToNot(BeEmpty())
+			waitForEntry()
+
+			w = request("", "")
+
+			Expect(w.Header().Get("X-Pistache")).To(Equal(handlers.CacheStatusHit))
+			Expect(w.Header()).ToNot(HaveKey("X-Pistache-Key"))
+		})
+	})
+
+	It("should serve a HEAD request from the cached GET response", func() {
+		s = &mockHitCacheService{
+			response: &models.Response{
+				StatusCode: http.StatusOK,
+				Header:     map[string][]string{"Content-Type": {"text/plain"}},
+				Body:       []byte("0123456789"),
+			},
+		}
+		h = handlers.NewCache(s, &mockProxyService{})
+
+		r, err := http.NewRequest("HEAD", "/", nil)
+		Expect(err).ToNot(HaveOccurred())
+		c := e.NewContext(r, w)
+
+		Expect(h.Handle(c)).To(Succeed())
+
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(w.Header().Get("Content-Length")).To(Equal("10"))
+		Expect(w.Header().Get("Content-Type")).To(Equal("text/plain"))
+		Expect(w.Body.Len()).To(BeZero())
+	})
+
+	It("should fetch a HEAD miss with GET and store it", func() {
+		cs := &mockMissCacheService{stored: make(chan *models.Response, 1)}
+		ps := &recordingProxyService{}
+		h = handlers.NewCache(cs, ps)
+
+		r, err := http.NewRequest("HEAD", "/", nil)
+		Expect(err).ToNot(HaveOccurred())
+		c := e.NewContext(r, w)
+
+		Expect(h.Handle(c)).To(Succeed())
+
+		Expect(ps.method).To(Equal(http.MethodGet))
+		Expect(c.Request().Method).To(Equal(http.MethodHead))
+		Eventually(cs.stored).Should(Receive())
+	})
+
+	It("should wait for the responses stored in the background", func() {
+		cs := &mockMissCacheService{stored: make(chan *models.Response)}
+		h = handlers.NewCache(cs, &recordingProxyService{})
+
+		r, err := http.NewRequest("GET", "/", nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(h.Handle(e.NewContext(r, w))).To(Succeed())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		Expect(h.Wait(ctx)).To(MatchError(context.DeadlineExceeded))
+
+		Eventually(cs.stored).Should(Receive())
+		Expect(h.Wait(context.Background())).To(Succeed())
+	})
+
+	It("should explain the key to the requests with the secret", func() {
+		h = handlers.NewCache(&mockMissCacheService{stored: make(chan *models.Response, 1)}, &mockProxyService{})
+		r, err := http.NewRequest("GET", "/", nil)
+		Expect(err).ToNot(HaveOccurred())
+		r.Header.Set("X-Pistache-Debug", "secret")
+
+		Expect(h.Handle(e.NewContext(r, w))).To(Succeed())
+		Expect(w.Header().Get("X-Pistache-Key")).To(ContainSubstring(`"key":"{test}-key-"`))
+	})
+
+	It("should not explain the key without the secret", func() {
+		h = handlers.NewCache(&mockMissCacheService{stored: make(chan *models.Response, 1)}, &mockProxyService{})
+		r, err := http.NewRequest("GET", "/", nil)
+		Expect(err).ToNot(HaveOccurred())
+		r.Header.Set("X-Pistache-Debug", "guess")
+
+		Expect(h.Handle(e.NewContext(r, w))).To(Succeed())
+		Expect(w.Header()).ToNot(HaveKey("X-Pistache-Key"))
+	})
+
+	It("should report a skipped request in Cache-Status", func() {
+		h = handlers.NewCache(s, &respondingProxyService{})
+		r, err := http.NewRequest("GET", "/", nil)
+		Expect(err).ToNot(HaveOccurred())
+		c := e.NewContext(r, w)
+
+		Expect(h.Handle(c)).To(Succeed())
+
+		Expect(w.Header().Get("X-Pistache")).To(Equal("skipped"))
+		Expect(w.Header().Values("Cache-Status")).To(Equal([]string{"Origin; hit", "Pistache; fwd=bypass"}))
+	})
+	It("should return the proxy error when nothing was sent", func() {
+		h = handlers.NewCache(s, &failingProxyService{})
+		r, err := http.NewRequest("GET", "/", nil)
+		Expect(err).ToNot(HaveOccurred())
+		c := e.NewContext(r, w)
+
+		err = h.Handle(c)
+		Expect(err).To(HaveOccurred())
+		e.HTTPErrorHandler(err, c)
+		Expect(w.Code).To(Equal(http.StatusBadGateway))
+	})
+	It("should answer a gateway timeout when the upstream times out", func() {
+		h = handlers.NewCache(s, &timingOutProxyService{})
+		r, err := http.NewRequest("GET", "/", nil)
+		Expect(err).ToNot(HaveOccurred())
+		c := e.NewContext(r, w)
+
+		e.HTTPErrorHandler(h.Handle(c), c)
+		Expect(w.Code).To(Equal(http.StatusGatewayTimeout))
+	})
+	It("should count the requests by route and cache status", func() {
+		s = &mockHitCacheService{
+			response: &models.Response{StatusCode: http.StatusOK, Body: []byte("cached"), Tier: services.TierRedis},
+		}
+		h = handlers.NewCache(s, &mockProxyService{})
+		r, err := http.NewRequest("GET", "/", nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(h.Handle(e.NewContext(r, w))).To(Succeed())
+
+		metrics := httptest.NewRecorder()
+		promhttp.Handler().ServeHTTP(metrics, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		Expect(metrics.Body.String()).To(ContainSubstring(`pistache_cache_requests_total{route="default",status="hit",tier="redis"}`))
+	})
 })
@@ -3,15 +3,146 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
+	"strconv"
 
 	"github.com/labstack/echo/v4"
+	"github.com/mfamador/pistache/internal/services"
 )
 
 // Controller implements the logic to handle requests
-type Controller struct{}
+type Controller struct {
+	Proxy     services.Proxy
+	Cache     services.Cache
+	Readiness services.Readiness
+}
+
+// keyRequest describes the request whose key is explained
+type keyRequest struct {
+	Method string `json:"method"`
+	// URL is either a path or an absolute URL, with the query
+	URL     string              `json:"url"`
+	Host    string              `json:"host"`
+	Headers map[string][]string `json:"headers"`
+}
 
-// Healthz GET /healthz controller function
+// Healthz GET /healthz and /livez controller function. It only tells the app
+// is running
 func (ct *Controller) Healthz(c echo.Context) error {
 	return c.NoContent(http.StatusNoContent)
 }
+
+// Readyz GET /readyz controller function. It replies 503 until the app can
+// serve traffic
+func (ct *Controller) Readyz(c echo.Context) error {
+	report := ct.Readiness.Check(c.Request().Context())
+	if !report.Ready {
+		return c.JSON(http.StatusServiceUnavailable, report)
+	}
+
+	return c.JSON(http.StatusOK, report)
+}
+
+// ExplainKey POST /cache/explain controller function
+func (ct *Controller) ExplainKey(c echo.Context) error {
+	var kr keyRequest
+	if err := c.Bind(&kr); err != nil {
+		return err
+	}
+
+	if kr.Method == "" {
+		kr.Method = http.MethodGet
+	}
+	req, err := http.NewRequestWithContext(c.Request().Context(), kr.Method, kr.URL, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if kr.Host != "" {
+		req.Host = kr.Host
+	}
+	req.RequestURI = req.URL.RequestURI()
+	for k, v := range kr.Headers {
+		req.Header[http.CanonicalHeaderKey(k)] = v
+	}
+
+	e, err := ct.Cache.ExplainKey(req)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, e)
+}
+
+// CacheKeys GET /cache/keys controller function
+func (ct *Controller) CacheKeys(c echo.Context) error {
+	tier := c.QueryParam("tier")
+	if tier == "" {
+		tier = services.TierMemory
+	}
+
+	var count int
+	if v := c.QueryParam("count"); v != "" {
+		var err error
+		if count, err = strconv.Atoi(v); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid count")
+		}
+	}
+
+	page, err := ct.Cache.Keys(tier, c.QueryParam("prefix"), c.QueryParam("cursor"), count)
+	if errors.Is(err, services.ErrUnknownTier) {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, page)
+}
+
+// CacheEntry GET /cache/entry controller function
+func (ct *Controller) CacheEntry(c echo.Context) error {
+	e, err := ct.entry(c)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, e)
+}
+
+// CacheEntryBody GET /cache/entry/body controller function
+func (ct *Controller) CacheEntryBody(c echo.Context) error {
+	e, err := ct.entry(c)
+	if err != nil {
+		return err
+	}
+
+	return c.Blob(http.StatusOK, extractContentType(e.Header), e.Body)
+}
+
+func (ct *Controller) entry(c echo.Context) (*services.Entry, error) {
+	key := c.QueryParam("key")
+	if key == "" {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "missing key")
+	}
+
+	e, err := ct.Cache.Entry(key)
+	if err != nil {
+		return nil, err
+	}
+	if e == nil {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "no cached entry")
+	}
+
+	return e, nil
+}
+
+// CacheStats GET /cache/stats controller function
+func (ct *Controller) CacheStats(c echo.Context) error {
+	return c.JSON(http.StatusOK, ct.Cache.Stats())
+}
+
+// Upstreams GET /upstreams controller function
+func (ct *Controller) Upstreams(c echo.Context) error {
+	return c.JSON(http.StatusOK, ct.Proxy.Upstreams())
+}
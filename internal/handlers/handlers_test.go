@@ -4,12 +4,14 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/labstack/echo/v4"
 	"github.com/mfamador/pistache/internal/config"
 	"github.com/mfamador/pistache/internal/handlers"
 	_ "github.com/mfamador/pistache/internal/logger"
+	"github.com/mfamador/pistache/internal/services"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
@@ -45,4 +47,123 @@ var _ = Describe("Handlers", func() {
 			Expect(w.Code).To(Equal(204))
 		})
 	})
+
+	Context("GET /readyz", func() {
+		readyz := func(proxy services.Proxy) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			r, _ := http.NewRequest("GET", "/readyz", nil)
+			c := echo.New().NewContext(r, w)
+			cache := &mockCacheService{}
+			ct := handlers.Controller{Readiness: services.NewReadiness(services.ReadinessConfig{}, proxy, cache)}
+
+			Expect(ct.Readyz(c)).To(Succeed())
+
+			return w
+		}
+
+		It("should return 200 with the state of the dependencies", func() {
+			w := readyz(&mockProxyService{})
+
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(w.Body.String()).To(ContainSubstring(`"ready":true`))
+			Expect(w.Body.String()).To(ContainSubstring(`"name":"upstreams"`))
+		})
+
+		It("should return 503 without a healthy upstream", func() {
+			w := readyz(&unhealthyProxyService{})
+
+			Expect(w.Code).To(Equal(http.StatusServiceUnavailable))
+			Expect(w.Body.String()).To(ContainSubstring(`"ready":false`))
+		})
+	})
+
+	Context("GET /upstreams", func() {
+		It("should return the upstream states", func() {
+			w := httptest.NewRecorder()
+			r, _ := http.NewRequest("GET", "/upstreams", nil)
+			c := echo.New().NewContext(r, w)
+			ct := handlers.Controller{Proxy: &mockProxyService{}}
+
+			Expect(ct.Upstreams(c)).To(Succeed())
+
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(w.Body.String()).To(ContainSubstring(`"name":"localhost:8000"`))
+			Expect(w.Body.String()).To(ContainSubstring(`"healthy":true`))
+		})
+	})
+
+	Context("POST /cache/explain", func() {
+		explain := func(body string) (*httptest.ResponseRecorder, error) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/cache/explain", strings.NewReader(body))
+			r.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			c := echo.New().NewContext(r, w)
+			ct := handlers.Controller{Cache: &mockCacheService{}}
+
+			return w, ct.ExplainKey(c)
+		}
+
+		It("should explain the key of the described request", func() {
+			w, err := explain(`{"method": "HEAD", "url": "/path?q=1", "host": "example.com"}`)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(w.Body.String()).To(ContainSubstring(`"url":"/path?q=1"`))
+			Expect(w.Body.String()).To(ContainSubstring(`"canonical":"HEADexample.com"`))
+			Expect(w.Body.String()).To(ContainSubstring(`"tiers":[{"tier":"memory","present":false}]`))
+		})
+
+		It("should refuse an invalid request", func() {
+			_, err := explain(`{"method": "bad method", "url": "/"}`)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("cache inspection", func() {
+		get := func(handler func(*handlers.Controller, echo.Context) error, target string) (*httptest.ResponseRecorder, error) {
+			w := httptest.NewRecorder()
+			c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, target, nil), w)
+			ct := &handlers.Controller{Cache: &mockCacheService{}}
+
+			return w, handler(ct, c)
+		}
+
+		It("should list the keys of a tier by prefix", func() {
+			w, err := get((*handlers.Controller).CacheKeys, "/cache/keys?prefix=%7Btest%7D-&cursor=c&count=10")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(w.Body.String()).To(MatchJSON(`{"keys": ["{test}-key-"], "cursor": "c10"}`))
+		})
+
+		It("should refuse an unknown tier or an invalid count", func() {
+			_, err := get((*handlers.Controller).CacheKeys, "/cache/keys?tier=disk")
+			Expect(err).To(MatchError(ContainSubstring("unknown cache tier")))
+			_, err = get((*handlers.Controller).CacheKeys, "/cache/keys?count=many")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should describe an entry", func() {
+			w, err := get((*handlers.Controller).CacheEntry, "/cache/entry?key=%7Btest%7D-key-")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(w.Body.String()).To(ContainSubstring(`"size":6`))
+			Expect(w.Body.String()).ToNot(ContainSubstring("cached"))
+		})
+
+		It("should send the body of an entry", func() {
+			w, err := get((*handlers.Controller).CacheEntryBody, "/cache/entry/body?key=%7Btest%7D-key-")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(w.Header().Get("Content-Type")).To(Equal("text/plain"))
+			Expect(w.Body.String()).To(Equal("cached"))
+		})
+
+		It("should answer not found for a missing entry", func() {
+			_, err := get((*handlers.Controller).CacheEntry, "/cache/entry?key=missing")
+			Expect(err).To(Equal(echo.NewHTTPError(http.StatusNotFound, "no cached entry")))
+		})
+
+		It("should report the stats of the tiers", func() {
+			w, err := get((*handlers.Controller).CacheStats, "/cache/stats")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(w.Body.String()).To(ContainSubstring(`"tier":"memory"`))
+		})
+	})
 })
@@ -1,13 +1,43 @@
 // Package models defines the model entities
 package models
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"time"
+)
 
 // Response defines the response entity to cache
 type Response struct {
 	StatusCode int                 `json:"statusCode"`
 	Header     map[string][]string `json:"header"`
 	Body       []byte              `json:"body"`
+	StoredAt   time.Time           `json:"storedAt"`
+	ExpiresAt  time.Time           `json:"expiresAt"`
+	// InitialAge is the age in seconds reported by the upstream, if any
+	InitialAge int64 `json:"initialAge,omitempty"`
+	// RequestID is the ID of the request the response was fetched for
+	RequestID string `json:"requestId,omitempty"`
+	// Tier is the cache tier the response was fetched from. It is never stored
+	Tier string `json:"-"`
+}
+
+// Age returns the age of the response, including the upstream age
+func (s *Response) Age(now time.Time) time.Duration {
+	age := time.Duration(s.InitialAge) * time.Second
+	if s.StoredAt.IsZero() || now.Before(s.StoredAt) {
+		return age
+	}
+
+	return age + now.Sub(s.StoredAt)
+}
+
+// TTL returns how long the response can still be served from the cache
+func (s *Response) TTL(now time.Time) time.Duration {
+	if now.After(s.ExpiresAt) {
+		return 0
+	}
+
+	return s.ExpiresAt.Sub(now)
 }
 
 // MarshalBinary implements encoding.MarshalBinary interface to be marshaled by redis
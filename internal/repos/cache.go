@@ -2,6 +2,7 @@
 package repos
 
 import (
+	"context"
 	"time"
 
 	"github.com/mfamador/pistache/internal/models"
@@ -9,6 +10,23 @@ import (
 
 // Cache exposes the interface to access a data source
 type Cache interface {
-	Fetch(string) (*models.Response, error)
-	Store(string, *models.Response, time.Duration) bool
+	Fetch(ctx context.Context, key string) (*models.Response, error)
+	Store(ctx context.Context, key string, response *models.Response, ttl time.Duration) bool
+	// Keys lists up to count keys starting with prefix, from the cursor of
+	// the previous page. The returned cursor is empty after the last page
+	Keys(prefix, cursor string, count int) ([]string, string, error)
+	// Stats returns the size of the data source
+	Stats() (CacheStats, error)
+	// Ping tells if the data source can be reached
+	Ping(ctx context.Context) error
+	// Close releases the connections to the data source
+	Close() error
+}
+
+// CacheStats describes the size of a data source
+type CacheStats struct {
+	// Entries is the number of entries stored
+	Entries int64 `json:"entries"`
+	// Bytes is the memory used, as the data source accounts it
+	Bytes int64 `json:"bytes"`
 }
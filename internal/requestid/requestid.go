@@ -0,0 +1,81 @@
+// Package requestid defines the request IDs and the request scoped logger
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// Header carries the request ID, from the client to the upstreams and back
+	Header = "X-Request-Id"
+	// LogField is the log field of the request ID
+	LogField = "request_id"
+	// maxLength of an ID accepted from a client
+	maxLength = 128
+)
+
+type contextKey struct{}
+
+type requestContext struct {
+	id     string
+	logger zerolog.Logger
+}
+
+// New generates a random request ID
+func New() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Error().Err(err).Msg("Failed to generate a request ID")
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// Valid tells if an ID sent by a client can be used as it is. It must be
+// short and only have visible ASCII characters, as it ends up in the logs
+func Valid(id string) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// NewContext returns a copy of ctx carrying the request ID, and a logger
+// adding it to every line
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, &requestContext{
+		id:     id,
+		logger: log.With().Str(LogField, id).Logger(),
+	})
+}
+
+// FromContext returns the request ID of ctx, if any
+func FromContext(ctx context.Context) string {
+	if rc, ok := ctx.Value(contextKey{}).(*requestContext); ok {
+		return rc.id
+	}
+
+	return ""
+}
+
+// Logger returns the logger of the request of ctx, or the global logger
+// outside of requests
+func Logger(ctx context.Context) *zerolog.Logger {
+	if rc, ok := ctx.Value(contextKey{}).(*requestContext); ok {
+		return &rc.logger
+	}
+
+	return &log.Logger
+}
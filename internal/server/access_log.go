@@ -0,0 +1,355 @@
+// Package server defines the app server boot
+package server
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mfamador/pistache/internal/handlers"
+	"github.com/mfamador/pistache/internal/requestid"
+	"github.com/rs/zerolog"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Access log formats
+const (
+	AccessLogJSON     = "json"
+	AccessLogCombined = "combined"
+	AccessLogLogfmt   = "logfmt"
+)
+
+const combinedTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// AccessLogConfig contains the access log options. The access log doesn't
+// depend on the level of the application logs
+type AccessLogConfig struct {
+	// Level is the lowest level logged. Requests are logged at info, client
+	// errors at warn and server errors at error. Set to disabled to turn the
+	// access log off
+	Level string `yaml:"level"`
+	// Format is one of json, combined or logfmt
+	Format string `yaml:"format"`
+	// Fields are the fields logged, in order. The combined format always has
+	// its own fields, and appends the other ones
+	Fields []string `yaml:"fields"`
+	// File the access log is written to. Logs go to stdout if not set
+	File string `yaml:"file"`
+	// MaxSize of the file in megabytes before it's rotated
+	MaxSize int `yaml:"maxSize"`
+	// MaxBackups is the number of rotated files kept
+	MaxBackups int `yaml:"maxBackups"`
+	// MaxAge is the number of days rotated files are kept
+	MaxAge int `yaml:"maxAge"`
+	// Compress the rotated files with gzip
+	Compress bool `yaml:"compress"`
+	// HitSampleRatio is the ratio of the successful cache hits logged,
+	// between 0 and 1. If not set, every hit is logged
+	HitSampleRatio float64 `yaml:"hitSampleRatio"`
+}
+
+// accessEntry is a request to log
+type accessEntry struct {
+	c       echo.Context
+	err     error
+	start   time.Time
+	latency time.Duration
+}
+
+func (a *accessEntry) cacheStatus() string {
+	status, _ := a.c.Get(handlers.CacheStatusContextKey).(string)
+	return status
+}
+
+// accessLogFields are the fields that can be logged
+var accessLogFields = map[string]func(*accessEntry) interface{}{
+	"time":       func(a *accessEntry) interface{} { return a.start },
+	"remote_ip":  func(a *accessEntry) interface{} { return a.c.RealIP() },
+	"host":       func(a *accessEntry) interface{} { return a.c.Request().Host },
+	"method":     func(a *accessEntry) interface{} { return a.c.Request().Method },
+	"uri":        func(a *accessEntry) interface{} { return a.c.Request().RequestURI },
+	"proto":      func(a *accessEntry) interface{} { return a.c.Request().Proto },
+	"user_agent": func(a *accessEntry) interface{} { return a.c.Request().UserAgent() },
+	"referer":    func(a *accessEntry) interface{} { return a.c.Request().Referer() },
+	"status":     func(a *accessEntry) interface{} { return a.c.Response().Status },
+	"latency":    func(a *accessEntry) interface{} { return a.latency.Seconds() },
+	"bytes_in":   func(a *accessEntry) interface{} { return bytesIn(a.c) },
+	"bytes_out":  func(a *accessEntry) interface{} { return a.c.Response().Size },
+	"request_id": func(a *accessEntry) interface{} { return requestid.FromContext(a.c.Request().Context()) },
+	"cache_tier": func(a *accessEntry) interface{} {
+		tier, _ := a.c.Get(handlers.CacheTierContextKey).(string)
+		return tier
+	},
+	"cache_status": func(a *accessEntry) interface{} { return a.cacheStatus() },
+	"error": func(a *accessEntry) interface{} {
+		if a.err == nil {
+			return ""
+		}
+		return a.err.Error()
+	},
+}
+
+// defaultAccessLogFields are logged if no fields are set
+var defaultAccessLogFields = []string{
+	"time", "remote_ip", "host", "method", "uri", "user_agent", "status", "latency",
+	"bytes_in", "bytes_out", "request_id", "cache_status", "cache_tier", "error",
+}
+
+// combinedFields are part of the Combined Log Format
+var combinedFields = []string{"time", "remote_ip", "method", "uri", "proto", "status", "bytes_out", "referer", "user_agent"}
+
+// AccessLog writes a line for every request
+type AccessLog struct {
+	level  zerolog.Level
+	format string
+	fields []string
+	out    io.Writer
+	json   zerolog.Logger
+	// hitRatio is the ratio of the cache hits logged
+	hitRatio float64
+}
+
+// NewAccessLog creates the access log
+func NewAccessLog(conf AccessLogConfig) (*AccessLog, error) {
+	level := zerolog.InfoLevel
+	if conf.Level != "" {
+		var err error
+		if level, err = zerolog.ParseLevel(conf.Level); err != nil {
+			return nil, err
+		}
+	}
+
+	format := conf.Format
+	switch format {
+	case "":
+		format = AccessLogJSON
+	case AccessLogJSON, AccessLogCombined, AccessLogLogfmt:
+	default:
+		return nil, fmt.Errorf("invalid access log format %q", conf.Format)
+	}
+
+	fields := conf.Fields
+	if len(fields) == 0 {
+		fields = defaultAccessLogFields
+	}
+	for _, f := range fields {
+		if _, ok := accessLogFields[f]; !ok {
+			return nil, fmt.Errorf("unknown access log field %q", f)
+		}
+	}
+	if format == AccessLogCombined {
+		// The combined fields come first, in their own format
+		var extra []string
+		for _, f := range fields {
+			if !containsString(combinedFields, f) {
+				extra = append(extra, f)
+			}
+		}
+		fields = extra
+	}
+
+	var out io.Writer = os.Stdout
+	if conf.File != "" {
+		out = &lumberjack.Logger{
+			Filename:   conf.File,
+			MaxSize:    conf.MaxSize,
+			MaxBackups: conf.MaxBackups,
+			MaxAge:     conf.MaxAge,
+			Compress:   conf.Compress,
+		}
+	}
+
+	hitRatio := 1.0
+	if conf.HitSampleRatio > 0 && conf.HitSampleRatio < 1 {
+		hitRatio = conf.HitSampleRatio
+	}
+
+	return &AccessLog{
+		level:    level,
+		format:   format,
+		fields:   fields,
+		out:      out,
+		json:     zerolog.New(out),
+		hitRatio: hitRatio,
+	}, nil
+}
+
+// Middleware is an echo middleware logging the requests. It replies with the
+// errors of the handlers, so their status is logged
+func (l *AccessLog) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		err := next(c)
+		if err != nil {
+			c.Error(err)
+		}
+
+		a := &accessEntry{c: c, err: err, start: start, latency: time.Since(start)}
+		if l.logs(a) {
+			l.write(a)
+		}
+
+		return nil
+	}
+}
+
+// Close closes the log file, if any. Rotated files are reopened on the next
+// write
+func (l *AccessLog) Close() error {
+	if c, ok := l.out.(io.Closer); ok && l.out != os.Stdout {
+		return c.Close()
+	}
+
+	return nil
+}
+
+// logs tells if a request is logged, given its level and cache status
+func (l *AccessLog) logs(a *accessEntry) bool {
+	level := zerolog.InfoLevel
+	switch status := a.c.Response().Status; {
+	case a.err != nil || status >= 500:
+		level = zerolog.ErrorLevel
+	case status >= 400:
+		level = zerolog.WarnLevel
+	}
+
+	if l.level == zerolog.Disabled || level < l.level {
+		return false
+	}
+
+	if level == zerolog.InfoLevel && a.cacheStatus() == handlers.CacheStatusHit && l.hitRatio < 1 {
+		//nolint:gosec // Sampling doesn't need a secure source
+		return rand.Float64() < l.hitRatio
+	}
+
+	return true
+}
+
+func (l *AccessLog) write(a *accessEntry) {
+	switch l.format {
+	case AccessLogCombined:
+		l.writeCombined(a)
+	case AccessLogLogfmt:
+		l.writeLogfmt(a)
+	default:
+		l.writeJSON(a)
+	}
+}
+
+func (l *AccessLog) writeJSON(a *accessEntry) {
+	e := l.json.Log()
+	for _, f := range l.fields {
+		switch v := accessLogFields[f](a).(type) {
+		case string:
+			// Missing values, like the tier of a miss, are left out
+			if v != "" {
+				e.Str(f, v)
+			}
+		case time.Time:
+			e.Time(f, v)
+		default:
+			e.Interface(f, v)
+		}
+	}
+	e.Send()
+}
+
+func (l *AccessLog) writeLogfmt(a *accessEntry) {
+	var b strings.Builder
+	for _, f := range l.fields {
+		v := formatValue(accessLogFields[f](a))
+		if v == "" {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(f)
+		b.WriteByte('=')
+		b.WriteString(logfmtValue(v))
+	}
+	b.WriteByte('\n')
+
+	_, _ = io.WriteString(l.out, b.String())
+}
+
+// writeCombined writes a line in the Combined Log Format, followed by the
+// other fields, quoted
+func (l *AccessLog) writeCombined(a *accessEntry) {
+	req := a.c.Request()
+	res := a.c.Response()
+
+	size := "-"
+	if res.Size > 0 {
+		size = strconv.FormatInt(res.Size, 10)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s - - [%s] %q %d %s %q %q",
+		a.c.RealIP(),
+		a.start.Format(combinedTimeFormat),
+		req.Method+" "+req.RequestURI+" "+req.Proto,
+		res.Status,
+		size,
+		orDash(req.Referer()),
+		orDash(req.UserAgent()),
+	)
+	for _, f := range l.fields {
+		fmt.Fprintf(&b, " %q", orDash(formatValue(accessLogFields[f](a))))
+	}
+	b.WriteByte('\n')
+
+	_, _ = io.WriteString(l.out, b.String())
+}
+
+func formatValue(v interface{}) string {
+	switch t := v.(type) {
+	case time.Time:
+		return t.Format(time.RFC3339)
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	default:
+		return fmt.Sprint(t)
+	}
+}
+
+// logfmtValue quotes the values that would be ambiguous otherwise
+func logfmtValue(s string) string {
+	if strings.ContainsAny(s, " =\"\t\n") {
+		return strconv.Quote(s)
+	}
+
+	return s
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+
+	return s
+}
+
+func bytesIn(c echo.Context) int {
+	n, err := strconv.Atoi(c.Request().Header.Get(echo.HeaderContentLength))
+	if err != nil {
+		return 0
+	}
+
+	return n
+}
+
+func containsString(slice []string, s string) bool {
+	for _, v := range slice {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,125 @@
+package server_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mfamador/pistache/internal/handlers"
+	"github.com/mfamador/pistache/internal/server"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Access log", func() {
+	var (
+		dir     string
+		logFile string
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "pistache-access")
+		Expect(err).ToNot(HaveOccurred())
+		logFile = filepath.Join(dir, "access.log")
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	// serve sends a request to a server logging to the file, returning the
+	// logged lines
+	serve := func(conf server.AccessLogConfig, cacheStatus string, status int) []string {
+		conf.File = logFile
+		accessLog, err := server.NewAccessLog(conf)
+		Expect(err).ToNot(HaveOccurred())
+		defer accessLog.Close()
+
+		e := echo.New()
+		e.Use(accessLog.Middleware)
+		e.GET("/", func(c echo.Context) error {
+			c.Set(handlers.CacheStatusContextKey, cacheStatus)
+			if cacheStatus == handlers.CacheStatusHit {
+				c.Set(handlers.CacheTierContextKey, "memory")
+			}
+			if status >= http.StatusInternalServerError {
+				return echo.NewHTTPError(status)
+			}
+			return c.String(status, "body")
+		})
+
+		req := httptest.NewRequest(http.MethodGet, "/?q=1", nil)
+		req.Header.Set("User-Agent", "test agent")
+		e.ServeHTTP(httptest.NewRecorder(), req)
+
+		data, err := ioutil.ReadFile(logFile)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		Expect(err).ToNot(HaveOccurred())
+
+		return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	}
+
+	It("should log JSON lines with the cache status and tier", func() {
+		lines := serve(server.AccessLogConfig{}, handlers.CacheStatusHit, http.StatusOK)
+		Expect(lines).To(HaveLen(1))
+
+		var line map[string]interface{}
+		Expect(json.Unmarshal([]byte(lines[0]), &line)).To(Succeed())
+		Expect(line).To(HaveKeyWithValue("uri", "/?q=1"))
+		Expect(line).To(HaveKeyWithValue("status", 200.0))
+		Expect(line).To(HaveKeyWithValue("bytes_out", 4.0))
+		Expect(line).To(HaveKeyWithValue("cache_status", "hit"))
+		Expect(line).To(HaveKeyWithValue("cache_tier", "memory"))
+		Expect(line).ToNot(HaveKey("error"))
+	})
+
+	It("should only log the selected fields", func() {
+		lines := serve(server.AccessLogConfig{Fields: []string{"method", "status"}}, handlers.CacheStatusMiss, http.StatusOK)
+		Expect(lines).To(ConsistOf(`{"method":"GET","status":200}`))
+	})
+
+	It("should log in the Combined Log Format", func() {
+		lines := serve(server.AccessLogConfig{
+			Format: server.AccessLogCombined,
+			Fields: []string{"status", "cache_status", "cache_tier"},
+		}, handlers.CacheStatusMiss, http.StatusOK)
+		Expect(lines).To(HaveLen(1))
+		Expect(lines[0]).To(MatchRegexp(`^192\.0\.2\.1 - - \[[^\]]+\] "GET /\?q=1 HTTP/1\.1" 200 4 "-" "test agent" "miss" "-"$`))
+	})
+
+	It("should log in logfmt", func() {
+		lines := serve(server.AccessLogConfig{
+			Format: server.AccessLogLogfmt,
+			Fields: []string{"method", "user_agent", "status", "cache_status"},
+		}, handlers.CacheStatusSkipped, http.StatusOK)
+		Expect(lines).To(ConsistOf(`method=GET user_agent="test agent" status=200 cache_status=skipped`))
+	})
+
+	It("should only log the requests at or above its level", func() {
+		conf := server.AccessLogConfig{Level: "warn", Fields: []string{"status"}}
+		Expect(serve(conf, handlers.CacheStatusMiss, http.StatusOK)).To(BeEmpty())
+		Expect(serve(conf, handlers.CacheStatusMiss, http.StatusNotFound)).To(ConsistOf(`{"status":404}`))
+		Expect(serve(conf, handlers.CacheStatusMiss, http.StatusBadGateway)).To(HaveLen(2))
+	})
+
+	It("should sample the hits but not the misses", func() {
+		conf := server.AccessLogConfig{HitSampleRatio: 0.000001, Fields: []string{"cache_status"}}
+		Expect(serve(conf, handlers.CacheStatusHit, http.StatusOK)).To(BeEmpty())
+		Expect(serve(conf, handlers.CacheStatusMiss, http.StatusOK)).To(ConsistOf(`{"cache_status":"miss"}`))
+	})
+
+	It("should refuse unknown fields and formats", func() {
+		_, err := server.NewAccessLog(server.AccessLogConfig{Fields: []string{"nope"}})
+		Expect(err).To(HaveOccurred())
+		_, err = server.NewAccessLog(server.AccessLogConfig{Format: "xml"})
+		Expect(err).To(HaveOccurred())
+	})
+})
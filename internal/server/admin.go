@@ -0,0 +1,215 @@
+// Package server defines the app server boot
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mfamador/pistache/internal/requestid"
+)
+
+const (
+	adminRealm = "pistache"
+	// adminUserKey is the context key of the name of the authenticated caller
+	adminUserKey = "adminUser"
+)
+
+// AdminConfig protects the admin endpoints under /pistache. The health probes
+// are always open. The other endpoints are disabled unless tokens, users or
+// allowed IPs are configured, or they're explicitly left open
+type AdminConfig struct {
+	// Port of a separate listener for the endpoints under /pistache, health
+	// probes included. They're served with the proxied traffic if not set
+	Port int `yaml:"port"`
+	// Tokens accepted as bearer tokens, by name. The name identifies the
+	// caller in the audit log
+	Tokens map[string]string `yaml:"tokens" json:"-"`
+	// Users accepted with basic auth, and their passwords
+	Users map[string]string `yaml:"users" json:"-"`
+	// AllowedIPs are the IPs and CIDR ranges allowed to call the admin
+	// endpoints. Any IP is allowed if empty
+	AllowedIPs []string `yaml:"allowedIPs"`
+	// Insecure leaves the admin endpoints open to anyone when no tokens, users
+	// or allowed IPs are configured. They're disabled otherwise
+	Insecure bool `yaml:"insecure"`
+	// TrustProxyHeaders takes the client IP from the X-Forwarded-For and
+	// X-Real-IP headers instead of the connection. Only set it behind a proxy
+	// overwriting them
+	TrustProxyHeaders bool `yaml:"trustProxyHeaders"`
+}
+
+// AdminGuard restricts the admin endpoints to the allowed IPs and the
+// authenticated callers
+type AdminGuard struct {
+	networks   []*net.IPNet
+	tokens     map[string]string
+	users      map[string]string
+	trustProxy bool
+	insecure   bool
+}
+
+// NewAdminGuard creates the guard of the admin endpoints
+func NewAdminGuard(conf AdminConfig) (*AdminGuard, error) {
+	g := &AdminGuard{
+		tokens:     conf.Tokens,
+		users:      conf.Users,
+		trustProxy: conf.TrustProxyHeaders,
+		insecure:   conf.Insecure,
+	}
+
+	for _, allowed := range conf.AllowedIPs {
+		if !strings.Contains(allowed, "/") {
+			ip := net.ParseIP(allowed)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid admin allowed IP %q", allowed)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			g.networks = append(g.networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(allowed)
+		if err != nil {
+			return nil, fmt.Errorf("invalid admin allowed range %q: %w", allowed, err)
+		}
+		g.networks = append(g.networks, network)
+	}
+
+	return g, nil
+}
+
+// unrestricted tells if neither credentials nor allowed IPs are configured
+func (g *AdminGuard) unrestricted() bool {
+	return len(g.networks) == 0 && len(g.tokens) == 0 && len(g.users) == 0
+}
+
+// Middleware is an echo middleware refusing the callers outside the allowed
+// IPs, and the unauthenticated ones if any credentials are configured. Every
+// caller is refused if nothing is configured, unless insecure is set
+func (g *AdminGuard) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if g.unrestricted() && !g.insecure {
+			return echo.NewHTTPError(http.StatusForbidden, "admin endpoints disabled")
+		}
+
+		if !g.allowed(g.clientIP(c)) {
+			return echo.NewHTTPError(http.StatusForbidden)
+		}
+
+		if len(g.tokens) == 0 && len(g.users) == 0 {
+			return next(c)
+		}
+
+		user, ok := g.authenticate(c.Request())
+		if !ok {
+			scheme := "Bearer"
+			if len(g.users) > 0 {
+				scheme = "Basic"
+			}
+			challenge := fmt.Sprintf("%s realm=%q", scheme, adminRealm)
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, challenge)
+			return echo.NewHTTPError(http.StatusUnauthorized)
+		}
+		c.Set(adminUserKey, user)
+
+		return next(c)
+	}
+}
+
+func (g *AdminGuard) clientIP(c echo.Context) string {
+	if g.trustProxy {
+		return c.RealIP()
+	}
+
+	ip, _, err := net.SplitHostPort(c.Request().RemoteAddr)
+	if err != nil {
+		return c.Request().RemoteAddr
+	}
+
+	return ip
+}
+
+func (g *AdminGuard) allowed(clientIP string) bool {
+	if len(g.networks) == 0 {
+		return true
+	}
+
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return false
+	}
+	for _, network := range g.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// authenticate returns the name of the caller, if its credentials are valid.
+// Every credential is compared, so the time taken doesn't tell which matched
+func (g *AdminGuard) authenticate(req *http.Request) (string, bool) {
+	if name, password, ok := req.BasicAuth(); ok {
+		expected, known := g.users[name]
+		match := subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1
+
+		return name, known && match
+	}
+
+	auth := req.Header.Get(echo.HeaderAuthorization)
+	if len(auth) <= len("Bearer ") || !strings.EqualFold(auth[:len("Bearer ")], "Bearer ") {
+		return "", false
+	}
+	token := []byte(auth[len("Bearer "):])
+	var user string
+	for name, expected := range g.tokens {
+		if subtle.ConstantTimeCompare(token, []byte(expected)) == 1 {
+			user = name
+		}
+	}
+
+	return user, user != ""
+}
+
+// Audit is an echo middleware logging every call changing the state of the
+// app, including the refused ones. The audit log doesn't depend on the level of
+// the application logs. The caller is logged with the IP the guard checks
+func (g *AdminGuard) Audit(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		switch req.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			return next(c)
+		}
+
+		err := next(c)
+
+		status := c.Response().Status
+		if err != nil {
+			status = http.StatusInternalServerError
+			if he, ok := err.(*echo.HTTPError); ok {
+				status = he.Code
+			}
+		}
+		user, _ := c.Get(adminUserKey).(string)
+
+		requestid.Logger(req.Context()).Log().
+			Bool("audit", true).
+			Str("user", user).
+			Str("remote_ip", g.clientIP(c)).
+			Str("method", req.Method).
+			Str("uri", req.RequestURI).
+			Int("status", status).
+			Msg("Admin call")
+
+		return err
+	}
+}
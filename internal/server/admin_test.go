@@ -0,0 +1,181 @@
+package server_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mfamador/pistache/internal/server"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+var _ = Describe("Admin", func() {
+	var (
+		output   *bytes.Buffer
+		original zerolog.Logger
+	)
+
+	BeforeEach(func() {
+		original = log.Logger
+		output = new(bytes.Buffer)
+		log.Logger = zerolog.New(output).Level(zerolog.ErrorLevel)
+	})
+
+	AfterEach(func() {
+		log.Logger = original
+	})
+
+	// serve sends a request to an admin endpoint guarded by the config
+	serve := func(conf server.AdminConfig, method, remoteAddr string, auth func(*http.Request)) int {
+		guard, err := server.NewAdminGuard(conf)
+		Expect(err).ToNot(HaveOccurred())
+
+		e := echo.New()
+		admin := e.Group("/pistache", guard.Audit, guard.Middleware)
+		admin.Any("/cache", func(c echo.Context) error {
+			return c.NoContent(http.StatusNoContent)
+		})
+
+		req := httptest.NewRequest(method, "/pistache/cache", nil)
+		req.RemoteAddr = remoteAddr
+		if auth != nil {
+			auth(req)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		return rec.Code
+	}
+
+	bearer := func(token string) func(*http.Request) {
+		return func(req *http.Request) { req.Header.Set(echo.HeaderAuthorization, "Bearer "+token) }
+	}
+
+	basic := func(user, password string) func(*http.Request) {
+		return func(req *http.Request) { req.SetBasicAuth(user, password) }
+	}
+
+	Context("allowing IPs", func() {
+		conf := server.AdminConfig{AllowedIPs: []string{"10.0.0.0/8", "192.0.2.7", "2001:db8::1"}}
+
+		It("should allow the IPs in the ranges", func() {
+			Expect(serve(conf, http.MethodGet, "10.1.2.3:1234", nil)).To(Equal(http.StatusNoContent))
+			Expect(serve(conf, http.MethodGet, "192.0.2.7:1234", nil)).To(Equal(http.StatusNoContent))
+			Expect(serve(conf, http.MethodGet, "[2001:db8::1]:1234", nil)).To(Equal(http.StatusNoContent))
+		})
+
+		It("should refuse the other IPs", func() {
+			Expect(serve(conf, http.MethodGet, "192.0.2.8:1234", nil)).To(Equal(http.StatusForbidden))
+			Expect(serve(conf, http.MethodGet, "[2001:db8::2]:1234", nil)).To(Equal(http.StatusForbidden))
+		})
+
+		It("should only trust the forwarding headers if configured to", func() {
+			forwarded := func(req *http.Request) { req.Header.Set(echo.HeaderXForwardedFor, "10.0.0.1") }
+			Expect(serve(conf, http.MethodGet, "192.0.2.8:1234", forwarded)).To(Equal(http.StatusForbidden))
+
+			trusting := conf
+			trusting.TrustProxyHeaders = true
+			Expect(serve(trusting, http.MethodGet, "192.0.2.8:1234", forwarded)).To(Equal(http.StatusNoContent))
+		})
+
+		It("should refuse invalid IPs and ranges", func() {
+			_, err := server.NewAdminGuard(server.AdminConfig{AllowedIPs: []string{"10.0.0.300"}})
+			Expect(err).To(HaveOccurred())
+			_, err = server.NewAdminGuard(server.AdminConfig{AllowedIPs: []string{"10.0.0.0/40"}})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("authenticating", func() {
+		conf := server.AdminConfig{
+			Tokens: map[string]string{"deploy": "t0ken"},
+			Users:  map[string]string{"admin": "s3cret"},
+		}
+
+		It("should accept the known tokens and users", func() {
+			Expect(serve(conf, http.MethodGet, "192.0.2.1:1234", bearer("t0ken"))).To(Equal(http.StatusNoContent))
+			Expect(serve(conf, http.MethodGet, "192.0.2.1:1234", basic("admin", "s3cret"))).To(Equal(http.StatusNoContent))
+		})
+
+		It("should refuse missing or wrong credentials", func() {
+			Expect(serve(conf, http.MethodGet, "192.0.2.1:1234", nil)).To(Equal(http.StatusUnauthorized))
+			Expect(serve(conf, http.MethodGet, "192.0.2.1:1234", bearer("wrong"))).To(Equal(http.StatusUnauthorized))
+			Expect(serve(conf, http.MethodGet, "192.0.2.1:1234", basic("admin", "wrong"))).To(Equal(http.StatusUnauthorized))
+			Expect(serve(conf, http.MethodGet, "192.0.2.1:1234", basic("nobody", ""))).To(Equal(http.StatusUnauthorized))
+		})
+
+	})
+
+	Context("without credentials or allowed IPs", func() {
+		It("should refuse every caller", func() {
+			Expect(serve(server.AdminConfig{}, http.MethodGet, "127.0.0.1:1234", nil)).To(Equal(http.StatusForbidden))
+			Expect(serve(server.AdminConfig{}, http.MethodGet, "192.0.2.1:1234", bearer("t0ken"))).To(Equal(http.StatusForbidden))
+		})
+
+		It("should be open if insecure", func() {
+			conf := server.AdminConfig{Insecure: true}
+			Expect(serve(conf, http.MethodGet, "192.0.2.1:1234", nil)).To(Equal(http.StatusNoContent))
+		})
+	})
+
+	Context("auditing", func() {
+		conf := server.AdminConfig{Tokens: map[string]string{"deploy": "t0ken"}}
+
+		auditLines := func() []map[string]interface{} {
+			var lines []map[string]interface{}
+			for _, l := range strings.Split(strings.TrimSpace(output.String()), "\n") {
+				if l == "" {
+					continue
+				}
+				var line map[string]interface{}
+				Expect(json.Unmarshal([]byte(l), &line)).To(Succeed())
+				lines = append(lines, line)
+			}
+			return lines
+		}
+
+		It("should log the mutating calls whatever the log level", func() {
+			serve(conf, http.MethodPost, "192.0.2.1:1234", bearer("t0ken"))
+
+			lines := auditLines()
+			Expect(lines).To(HaveLen(1))
+			Expect(lines[0]).To(HaveKeyWithValue("audit", true))
+			Expect(lines[0]).To(HaveKeyWithValue("user", "deploy"))
+			Expect(lines[0]).To(HaveKeyWithValue("method", http.MethodPost))
+			Expect(lines[0]).To(HaveKeyWithValue("uri", "/pistache/cache"))
+			Expect(lines[0]).To(HaveKeyWithValue("status", 204.0))
+		})
+
+		It("should log the IP the guard checks", func() {
+			forged := func(req *http.Request) {
+				req.Header.Set(echo.HeaderXForwardedFor, "10.0.0.1")
+				bearer("t0ken")(req)
+			}
+			serve(conf, http.MethodPost, "192.0.2.1:1234", forged)
+
+			lines := auditLines()
+			Expect(lines).To(HaveLen(1))
+			Expect(lines[0]).To(HaveKeyWithValue("remote_ip", "192.0.2.1"))
+		})
+
+		It("should log the refused calls", func() {
+			serve(conf, http.MethodDelete, "192.0.2.1:1234", bearer("wrong"))
+
+			lines := auditLines()
+			Expect(lines).To(HaveLen(1))
+			Expect(lines[0]).To(HaveKeyWithValue("user", ""))
+			Expect(lines[0]).To(HaveKeyWithValue("status", 401.0))
+		})
+
+		It("should not log the reads", func() {
+			serve(conf, http.MethodGet, "192.0.2.1:1234", bearer("t0ken"))
+			Expect(auditLines()).To(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,32 @@
+// Package server defines the app server boot
+package server
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/mfamador/pistache/internal/requestid"
+)
+
+// RequestID is an echo middleware giving every request an ID. The client's
+// ID is kept if it sent a valid one. The ID is forwarded to the upstreams,
+// sent back to the client and added to the logs of the request
+func RequestID(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		id := req.Header.Get(requestid.Header)
+		if !requestid.Valid(id) {
+			id = requestid.New()
+			req.Header.Set(requestid.Header, id)
+		}
+
+		c.SetRequest(req.WithContext(requestid.NewContext(req.Context(), id)))
+
+		// Set last, so a header echoed by the upstream or stored with a
+		// cached response doesn't replace or duplicate it
+		res := c.Response()
+		res.Before(func() {
+			res.Header().Set(requestid.Header, id)
+		})
+
+		return next(c)
+	}
+}
@@ -0,0 +1,86 @@
+package server_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mfamador/pistache/internal/requestid"
+	"github.com/mfamador/pistache/internal/server"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+var _ = Describe("Request ID", func() {
+	var (
+		e        *echo.Echo
+		output   *bytes.Buffer
+		original zerolog.Logger
+		// seen is the ID of the last request, as the handler saw it
+		seen string
+	)
+
+	BeforeEach(func() {
+		original = log.Logger
+		output = new(bytes.Buffer)
+		log.Logger = zerolog.New(output)
+
+		var err error
+		e, err = server.Setup(server.Config{})
+		Expect(err).ToNot(HaveOccurred())
+		e.GET("/", func(c echo.Context) error {
+			ctx := c.Request().Context()
+			seen = requestid.FromContext(ctx)
+			requestid.Logger(ctx).Info().Msg("handling")
+			// An ID echoed by an upstream must not be duplicated
+			c.Response().Header().Set(requestid.Header, seen)
+			return c.NoContent(http.StatusOK)
+		})
+	})
+
+	AfterEach(func() {
+		log.Logger = original
+	})
+
+	send := func(id string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if id != "" {
+			req.Header.Set(requestid.Header, id)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	It("should keep the client's ID", func() {
+		rec := send("client-id")
+		Expect(seen).To(Equal("client-id"))
+		Expect(rec.Header().Values(requestid.Header)).To(ConsistOf("client-id"))
+	})
+
+	It("should generate an ID if the client sent none", func() {
+		rec := send("")
+		Expect(seen).To(HaveLen(32))
+		Expect(rec.Header().Get(requestid.Header)).To(Equal(seen))
+	})
+
+	It("should replace an invalid ID", func() {
+		send("bad id\n" + strings.Repeat("x", 200))
+		Expect(seen).To(HaveLen(32))
+	})
+
+	It("should add the ID to the logs of the request", func() {
+		send("logged-id")
+
+		var line map[string]interface{}
+		Expect(json.Unmarshal([]byte(strings.SplitN(output.String(), "\n", 2)[0]), &line)).To(Succeed())
+		Expect(line).To(HaveKeyWithValue(zerolog.MessageFieldName, "handling"))
+		Expect(line).To(HaveKeyWithValue(requestid.LogField, "logged-id"))
+	})
+})
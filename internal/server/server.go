@@ -2,17 +2,22 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	stderrors "errors"
 	"fmt"
 	"net/http"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	"github.com/mfamador/pistache/internal/requestid"
 	"github.com/mfamador/pistache/internal/services"
 
 	echoPrometheus "github.com/globocom/echo-prometheus"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/rs/zerolog/log"
+	"golang.org/x/net/http2"
 
 	"github.com/mfamador/pistache/internal/handlers"
 )
@@ -20,6 +25,18 @@ import (
 // Config defines the handler configuration
 type Config struct {
 	Port int `yaml:"port"`
+	// TLS terminates TLS on the listener. Set to nil to serve plain HTTP
+	TLS *TLSConfig `yaml:"tls"`
+	// H2C serves HTTP/2 without TLS, for in-cluster clients. Ignored with TLS
+	H2C bool `yaml:"h2c"`
+	// DisableHTTP2 only serves HTTP/1.1 over TLS
+	DisableHTTP2 bool `yaml:"disableHTTP2"`
+	// AccessLog logs every request
+	AccessLog AccessLogConfig `yaml:"accessLog"`
+	// Shutdown drains the requests before stopping
+	Shutdown ShutdownConfig `yaml:"shutdown"`
+	// Admin protects the endpoints under /pistache
+	Admin AdminConfig `yaml:"admin"`
 }
 
 type httpErrorMessage struct {
@@ -39,6 +56,12 @@ func customHTTPErrorHandler(err error, c echo.Context) {
 	default:
 		code = http.StatusInternalServerError
 		message = err.Error()
+
+		// Upstreams timing out aren't unreachable, tell them apart
+		if stderrors.Is(err, services.ErrUpstreamTimeout) {
+			code = http.StatusGatewayTimeout
+			message = services.ErrUpstreamTimeout.Error()
+		}
 	}
 
 	res := httpErrorMessage{Message: message, Errors: errors}
@@ -47,7 +70,8 @@ func customHTTPErrorHandler(err error, c echo.Context) {
 	if !c.Response().Committed {
 		var writeErr error
 
-		log.Error().Err(err).Interface("path", c.Path()).Msg(err.Error())
+		logger := requestid.Logger(c.Request().Context())
+		logger.Error().Err(err).Interface("path", c.Path()).Msg(err.Error())
 
 		if c.Request().Method == http.MethodHead {
 			writeErr = c.NoContent(code)
@@ -56,13 +80,24 @@ func customHTTPErrorHandler(err error, c echo.Context) {
 		}
 
 		if writeErr != nil {
-			log.Error().Err(writeErr).Msg("Failed to reply with the HTTP error")
+			logger.Error().Err(writeErr).Msg("Failed to reply with the HTTP error")
 		}
 	}
 }
 
 // Setup abstracts booting the echo framework
-func Setup() (*echo.Echo, error) {
+func Setup(conf Config) (*echo.Echo, error) {
+	accessLog, err := NewAccessLog(conf.AccessLog)
+	if err != nil {
+		return nil, err
+	}
+
+	return setup(accessLog), nil
+}
+
+// setup boots an echo instance logging to the access log, which can be shared
+// with the admin listener
+func setup(accessLog *AccessLog) *echo.Echo {
 	e := echo.New()
 
 	// Hide echo banner and port, so we only output valid logs
@@ -71,27 +106,38 @@ func Setup() (*echo.Echo, error) {
 
 	e.HTTPErrorHandler = customHTTPErrorHandler
 
-	e.Use(RequestLogger)
+	// The request ID and the span wrap the error handler, so its reply is
+	// logged with the ID and traced
+	e.Use(RequestID)
+	e.Use(Tracing)
+	e.Use(accessLog.Middleware)
 	e.Use(middleware.Recover())
 
-	return e, nil
+	return e
 }
 
-// Start starts the echo http server
-func Start(serverConfig Config, servicesConfig *services.Config) error {
-	e, err := Setup()
+// Start starts the echo http server, until the context is done. It's then
+// shut down gracefully
+func Start(ctx context.Context, serverConfig Config, servicesConfig *services.Config) error {
+	accessLog, err := NewAccessLog(serverConfig.AccessLog)
 	if err != nil {
 		return err
 	}
+	defer accessLog.Close()
 
-	c := handlers.Controller{}
-
-	// Define routes and middleware
-	e.Use(echoPrometheus.MetricsMiddleware())
+	guard, err := NewAdminGuard(serverConfig.Admin)
+	if err != nil {
+		return err
+	}
+	if guard.unrestricted() {
+		if guard.insecure {
+			log.Warn().Msg("Admin endpoints are open to anyone, configure tokens, users or allowed IPs")
+		} else {
+			log.Warn().Msg("Admin endpoints are disabled, configure tokens, users or allowed IPs, or set insecure")
+		}
+	}
 
-	pistache := e.Group("/pistache")
-	pistache.GET("/metrics", echo.WrapHandler(promhttp.Handler()))
-	pistache.GET("/healthz", c.Healthz)
+	e := setup(accessLog)
 
 	pService, err := services.NewProxy(servicesConfig.Proxy)
 	if err != nil {
@@ -105,11 +151,100 @@ func Start(serverConfig Config, servicesConfig *services.Config) error {
 		return err
 	}
 
+	readiness := services.NewReadiness(servicesConfig.Readiness, pService, cService)
+	c := handlers.Controller{Proxy: pService, Cache: cService, Readiness: readiness}
+
+	// Define routes and middleware
+	e.Use(echoPrometheus.MetricsMiddleware())
+
+	admin := e
+	if serverConfig.Admin.Port != 0 {
+		admin = setup(accessLog)
+	}
+
+	// The health probes stay open, the other endpoints are guarded
+	pistache := admin.Group("/pistache")
+	pistache.GET("/healthz", c.Healthz)
+	pistache.GET("/livez", c.Healthz)
+	pistache.GET("/readyz", c.Readyz)
+
+	guarded := pistache.Group("", guard.Audit, guard.Middleware)
+	guarded.GET("/metrics", echo.WrapHandler(promhttp.Handler()))
+	guarded.GET("/upstreams", c.Upstreams)
+	guarded.POST("/cache/explain", c.ExplainKey)
+	guarded.GET("/cache/keys", c.CacheKeys)
+	guarded.GET("/cache/entry", c.CacheEntry)
+	guarded.GET("/cache/entry/body", c.CacheEntryBody)
+	guarded.GET("/cache/stats", c.CacheStats)
+
 	cHandler := handlers.NewCache(cService, pService)
 
 	// Use our handler in case we hit the 'Skipper' target in ProxyMiddleware
 	e.Any("/*", cHandler.Handle)
 
+	var tlsConfig *tls.Config
+	if serverConfig.TLS != nil {
+		var reloader *CertReloader
+		tlsConfig, reloader, err = NewTLSConfig(serverConfig.TLS, serverConfig.DisableHTTP2)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to load TLS config")
+			return err
+		}
+		go reloader.Start()
+		defer reloader.Stop()
+	}
+
+	// The admin listener is shut down last, so the readiness can be probed
+	// while draining
+	d := &drainer{
+		conf:      serverConfig.Shutdown,
+		readiness: readiness,
+		servers:   []*echo.Echo{e},
+		proxy:     pService,
+		handler:   cHandler,
+		cache:     cService,
+	}
+
+	errs := make(chan error, 2)
+	if admin != e {
+		d.servers = append(d.servers, admin)
+		log.Info().Int("port", serverConfig.Admin.Port).Msg("Starting Pistache admin")
+		go func() {
+			errs <- serve(admin, serverConfig.Admin.Port, serverConfig, tlsConfig)
+		}()
+	}
+
 	log.Info().Int("Starting Pistache on port", serverConfig.Port)
-	return e.Start(fmt.Sprintf(":%d", serverConfig.Port))
+	go func() {
+		errs <- serve(e, serverConfig.Port, serverConfig, tlsConfig)
+	}()
+
+	select {
+	case err = <-errs:
+		// A listener failed, the other one is stopped right away
+		log.Error().Err(err).Msg("Server failed, shutting down")
+		if drainErr := d.drain(false); drainErr != nil {
+			log.Error().Err(drainErr).Msg("Failed to shut down gracefully")
+		}
+		return err
+	case <-ctx.Done():
+		log.Info().Msg("Shutting down Pistache")
+		return d.drain(true)
+	}
+}
+
+// serve starts an echo instance on a port, with the protocols of the config
+func serve(e *echo.Echo, port int, conf Config, tlsConfig *tls.Config) error {
+	address := fmt.Sprintf(":%d", port)
+
+	switch {
+	case tlsConfig != nil:
+		e.TLSServer.Addr = address
+		e.TLSServer.TLSConfig = tlsConfig
+		return e.StartServer(e.TLSServer)
+	case conf.H2C:
+		return e.StartH2CServer(address, &http2.Server{})
+	default:
+		return e.Start(address)
+	}
 }
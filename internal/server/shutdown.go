@@ -0,0 +1,83 @@
+// Package server defines the app server boot
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mfamador/pistache/internal/handlers"
+	"github.com/mfamador/pistache/internal/services"
+	"github.com/rs/zerolog/log"
+)
+
+const defaultShutdownTimeout = 30
+
+// ShutdownConfig contains the graceful shutdown options
+type ShutdownConfig struct {
+	// Delay in seconds between failing the readiness and closing the
+	// listeners, for the load balancers to stop sending traffic
+	Delay int `yaml:"delay"`
+	// Timeout in seconds to finish the in-flight requests and the responses
+	// being stored in the background
+	Timeout int `yaml:"timeout"`
+}
+
+// drainer shuts the app down without dropping the requests being served
+type drainer struct {
+	conf      ShutdownConfig
+	readiness services.Readiness
+	// servers are shut down in order
+	servers []*echo.Echo
+	proxy   services.Proxy
+	handler handlers.Cache
+	cache   services.Cache
+}
+
+// drain fails the readiness, waits for the delay if asked to, then stops
+// accepting connections and waits for the in-flight requests and the
+// background cache writes, until the timeout. The upstreams are no longer
+// probed once the requests are done, and the cache connections are closed last
+func (d *drainer) drain(delay bool) error {
+	d.readiness.Drain()
+
+	if delay && d.conf.Delay > 0 {
+		log.Info().Int("delay", d.conf.Delay).Msg("Failing readiness before shutting down")
+		time.Sleep(time.Duration(d.conf.Delay) * time.Second)
+	}
+
+	timeout := d.conf.Timeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	var err error
+	for _, e := range d.servers {
+		if shutdownErr := e.Shutdown(ctx); shutdownErr != nil {
+			log.Error().Err(shutdownErr).Msg("Failed to drain the in-flight requests")
+			if err == nil {
+				err = shutdownErr
+			}
+		}
+	}
+
+	d.proxy.Stop()
+
+	if waitErr := d.handler.Wait(ctx); waitErr != nil {
+		log.Error().Err(waitErr).Msg("Failed to store the pending responses")
+		if err == nil {
+			err = waitErr
+		}
+	}
+
+	if closeErr := d.cache.Close(); closeErr != nil {
+		log.Error().Err(closeErr).Msg("Failed to close the cache")
+		if err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,94 @@
+package server_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/mfamador/pistache/internal/server"
+	"github.com/mfamador/pistache/internal/services"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Shutdown", func() {
+	var (
+		upstream *httptest.Server
+		base     string
+		cancel   context.CancelFunc
+		done     chan error
+	)
+
+	BeforeEach(func() {
+		upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(300 * time.Millisecond)
+			_, _ = w.Write([]byte("slow"))
+		}))
+		u, err := url.Parse(upstream.URL)
+		Expect(err).ToNot(HaveOccurred())
+		upstreamPort, err := strconv.Atoi(u.Port())
+		Expect(err).ToNot(HaveOccurred())
+
+		// Find a free port for the server
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		port := l.Addr().(*net.TCPAddr).Port
+		Expect(l.Close()).To(Succeed())
+		base = fmt.Sprintf("http://127.0.0.1:%d", port)
+
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+		done = make(chan error, 1)
+		go func() {
+			done <- server.Start(ctx, server.Config{
+				Port:     port,
+				Shutdown: server.ShutdownConfig{Timeout: 5},
+			}, &services.Config{
+				Proxy: services.ProxyConfig{PoolConfig: services.PoolConfig{
+					Upstreams: []services.Upstream{{Host: u.Hostname(), Port: upstreamPort}},
+				}},
+			})
+		}()
+
+		Eventually(func() error {
+			resp, err := http.Get(base + "/pistache/livez")
+			if err == nil {
+				resp.Body.Close()
+			}
+			return err
+		}).Should(Succeed())
+	})
+
+	AfterEach(func() {
+		cancel()
+		upstream.Close()
+	})
+
+	It("should finish the in-flight requests before stopping", func() {
+		bodies := make(chan string, 1)
+		go func() {
+			defer GinkgoRecover()
+			resp, err := http.Get(base + "/slow")
+			Expect(err).ToNot(HaveOccurred())
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			Expect(err).ToNot(HaveOccurred())
+			bodies <- string(body)
+		}()
+
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+
+		Eventually(bodies, "2s").Should(Receive(Equal("slow")))
+		Eventually(done, "2s").Should(Receive(BeNil()))
+
+		_, err := http.Get(base + "/pistache/livez")
+		Expect(err).To(HaveOccurred())
+	})
+})
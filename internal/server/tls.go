@@ -0,0 +1,189 @@
+// Package server defines the TLS termination of the app server
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const defaultCertReloadInterval = 60
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSConfig defines the TLS termination configuration
+type TLSConfig struct {
+	// Cert and Key are the PEM files of the server certificate
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// MinVersion of TLS accepted. Can be one of 1.0, 1.1, 1.2 or 1.3
+	MinVersion string `yaml:"minVersion" default:"1.2"`
+	// CipherSuites accepted for TLS 1.2 and below, by name. If empty, the Go
+	// defaults are used
+	CipherSuites []string `yaml:"cipherSuites"`
+	// ReloadInterval is how often, in seconds, the certificate files are
+	// checked for changes
+	ReloadInterval int `yaml:"reloadInterval"`
+}
+
+// NewTLSConfig builds the tls.Config of the listener. The certificate is
+// reloaded by the returned CertReloader, once it's started
+func NewTLSConfig(conf *TLSConfig, disableHTTP2 bool) (*tls.Config, *CertReloader, error) {
+	reloader, err := NewCertReloader(conf.Cert, conf.Key, conf.ReloadInterval)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"http/1.1"},
+	}
+
+	if !disableHTTP2 {
+		tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+	}
+
+	if conf.MinVersion != "" {
+		version, ok := tlsVersions[conf.MinVersion]
+		if !ok {
+			return nil, nil, fmt.Errorf("invalid TLS version %q", conf.MinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if len(conf.CipherSuites) > 0 {
+		suites := make(map[string]uint16)
+		for _, s := range tls.CipherSuites() {
+			suites[s.Name] = s.ID
+		}
+
+		for _, name := range conf.CipherSuites {
+			id, ok := suites[name]
+			if !ok {
+				return nil, nil, fmt.Errorf("invalid or insecure cipher suite %q", name)
+			}
+			tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+		}
+	}
+
+	return tlsConfig, reloader, nil
+}
+
+// CertReloader serves a certificate, reloading it when its files change
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	interval time.Duration
+
+	mutex   sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+
+	stop chan struct{}
+}
+
+// NewCertReloader loads a certificate that will be checked for changes
+// every interval, in seconds
+func NewCertReloader(certFile, keyFile string, interval int) (*CertReloader, error) {
+	if interval <= 0 {
+		interval = defaultCertReloadInterval
+	}
+
+	r := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		interval: time.Duration(interval) * time.Second,
+		stop:     make(chan struct{}),
+	}
+
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// GetCertificate returns the current certificate, for tls.Config
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.cert, nil
+}
+
+// Reload loads the certificate if its files changed since the last load
+func (r *CertReloader) Reload() error {
+	modTime, err := r.lastModified()
+	if err != nil {
+		return err
+	}
+
+	r.mutex.RLock()
+	changed := r.cert == nil || !modTime.Equal(r.modTime)
+	r.mutex.RUnlock()
+	if !changed {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.mutex.Unlock()
+
+	log.Info().Str("cert", r.certFile).Msg("Loaded TLS certificate")
+
+	return nil
+}
+
+func (r *CertReloader) lastModified() (time.Time, error) {
+	var last time.Time
+	for _, f := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(f)
+		if err != nil {
+			return last, err
+		}
+		if info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+
+	return last, nil
+}
+
+// Start checks the certificate files until the reloader is stopped.
+// A certificate that fails to load keeps the previous one in use
+func (r *CertReloader) Start() {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.Reload(); err != nil {
+				log.Error().Err(err).Str("cert", r.certFile).Msg("Failed to reload TLS certificate")
+			}
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// Stop stops checking the certificate files
+func (r *CertReloader) Stop() {
+	close(r.stop)
+}
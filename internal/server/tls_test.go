@@ -0,0 +1,130 @@
+package server_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mfamador/pistache/internal/server"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// writeCert writes a self-signed certificate with the given serial number
+// and its key
+func writeCert(certFile, keyFile string, serial int64) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "pistache"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).ToNot(HaveOccurred())
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	Expect(err).ToNot(HaveOccurred())
+
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	Expect(ioutil.WriteFile(certFile, certPem, 0600)).To(Succeed())
+	Expect(ioutil.WriteFile(keyFile, keyPem, 0600)).To(Succeed())
+}
+
+func certSerial(r *server.CertReloader) int64 {
+	cert, err := r.GetCertificate(nil)
+	Expect(err).ToNot(HaveOccurred())
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	Expect(err).ToNot(HaveOccurred())
+
+	return parsed.SerialNumber.Int64()
+}
+
+var _ = Describe("TLS", func() {
+	var (
+		dir               string
+		certFile, keyFile string
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "pistache-tls")
+		Expect(err).ToNot(HaveOccurred())
+
+		certFile = filepath.Join(dir, "tls.crt")
+		keyFile = filepath.Join(dir, "tls.key")
+		writeCert(certFile, keyFile, 1)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("should build the listener config", func() {
+		tlsConfig, _, err := server.NewTLSConfig(&server.TLSConfig{
+			Cert:         certFile,
+			Key:          keyFile,
+			MinVersion:   "1.3",
+			CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+		}, false)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(tlsConfig.MinVersion).To(Equal(uint16(tls.VersionTLS13)))
+		Expect(tlsConfig.CipherSuites).To(Equal([]uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}))
+		Expect(tlsConfig.NextProtos).To(ContainElement("h2"))
+	})
+
+	It("should only offer HTTP/1.1 when HTTP/2 is disabled", func() {
+		tlsConfig, _, err := server.NewTLSConfig(&server.TLSConfig{Cert: certFile, Key: keyFile}, true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(tlsConfig.NextProtos).To(Equal([]string{"http/1.1"}))
+	})
+
+	It("should refuse unknown versions and cipher suites", func() {
+		_, _, err := server.NewTLSConfig(&server.TLSConfig{Cert: certFile, Key: keyFile, MinVersion: "2.0"}, false)
+		Expect(err).To(HaveOccurred())
+
+		_, _, err = server.NewTLSConfig(&server.TLSConfig{
+			Cert:         certFile,
+			Key:          keyFile,
+			CipherSuites: []string{"TLS_NOT_A_SUITE"},
+		}, false)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should reload the certificate when its files change", func() {
+		r, err := server.NewCertReloader(certFile, keyFile, 1)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(certSerial(r)).To(Equal(int64(1)))
+
+		writeCert(certFile, keyFile, 2)
+		later := time.Now().Add(time.Minute)
+		Expect(os.Chtimes(certFile, later, later)).To(Succeed())
+
+		Expect(r.Reload()).To(Succeed())
+		Expect(certSerial(r)).To(Equal(int64(2)))
+	})
+
+	It("should keep the certificate if the new one is invalid", func() {
+		r, err := server.NewCertReloader(certFile, keyFile, 1)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(ioutil.WriteFile(certFile, []byte("garbage"), 0600)).To(Succeed())
+		later := time.Now().Add(time.Minute)
+		Expect(os.Chtimes(certFile, later, later)).To(Succeed())
+
+		Expect(r.Reload()).ToNot(Succeed())
+		Expect(certSerial(r)).To(Equal(int64(1)))
+	})
+})
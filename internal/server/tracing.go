@@ -0,0 +1,39 @@
+// Package server defines the app server boot
+package server
+
+import (
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel/api/trace"
+	"go.opentelemetry.io/otel/semconv"
+)
+
+const tracerName = "github.com/mfamador/pistache/internal/server"
+
+// Tracing is an echo middleware starting a server span for every request,
+// continuing the trace propagated by the client
+func Tracing(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		ctx := global.TextMapPropagator().Extract(req.Context(), req.Header)
+
+		ctx, span := global.Tracer(tracerName).Start(ctx, "HTTP "+req.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(semconv.HTTPServerAttributesFromHTTPRequest("pistache", "", req)...),
+		)
+		defer span.End()
+
+		c.SetRequest(req.WithContext(ctx))
+
+		err := next(c)
+		if err != nil {
+			span.RecordError(ctx, err)
+		}
+
+		status := c.Response().Status
+		span.SetAttributes(semconv.HTTPAttributesFromHTTPStatusCode(status)...)
+		span.SetStatus(semconv.SpanStatusFromHTTPStatusCode(status))
+
+		return err
+	}
+}
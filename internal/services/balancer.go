@@ -0,0 +1,188 @@
+// Package services has the upstream load balancing
+package services
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var upstreamInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "pistache_upstream_in_flight_requests",
+	Help: "Number of requests being proxied to an upstream target",
+}, []string{"pool", "upstream"})
+
+// upstreamTarget is a proxy target along with its health state
+type upstreamTarget struct {
+	*middleware.ProxyTarget
+	weight   int
+	healthy  int32
+	inflight int64
+	// smooth weighted round robin state, guarded by the strategy
+	currentWeight int
+	// consecutive health check results, only used by the health checker
+	probeSuccesses int
+	probeFailures  int
+	outlier        outlierState
+}
+
+func newUpstreamTarget(target *middleware.ProxyTarget, weight int) *upstreamTarget {
+	if weight <= 0 {
+		weight = 1
+	}
+
+	return &upstreamTarget{
+		ProxyTarget: target,
+		weight:      weight,
+		healthy:     1,
+	}
+}
+
+// inFlight returns the number of requests being proxied to the target
+func (t *upstreamTarget) inFlight() int64 {
+	return atomic.LoadInt64(&t.inflight)
+}
+
+func (t *upstreamTarget) isHealthy() bool {
+	return atomic.LoadInt32(&t.healthy) == 1
+}
+
+// setHealthy updates the health state, returning true if it changed
+func (t *upstreamTarget) setHealthy(healthy bool) bool {
+	var v int32
+	if healthy {
+		v = 1
+	}
+
+	return atomic.SwapInt32(&t.healthy, v) != v
+}
+
+// available tells if the target can be part of the rotation
+func (t *upstreamTarget) available(now time.Time) bool {
+	return t.isHealthy() && !t.outlier.ejected(now)
+}
+
+// balancer is a middleware.ProxyBalancer that only picks targets in rotation,
+// using the configured strategy
+type balancer struct {
+	name     string
+	mutex    sync.RWMutex
+	targets  []*upstreamTarget
+	strategy strategy
+}
+
+func newBalancer(name string, targets []*upstreamTarget, s strategy) *balancer {
+	return &balancer{
+		name:     name,
+		targets:  targets,
+		strategy: s,
+	}
+}
+
+// AddTarget adds an upstream target to the rotation
+func (b *balancer) AddTarget(target *middleware.ProxyTarget) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, t := range b.targets {
+		if t.Name == target.Name {
+			return false
+		}
+	}
+
+	weight, _ := target.Meta["weight"].(int)
+	b.targets = append(b.targets, newUpstreamTarget(target, weight))
+
+	return true
+}
+
+// RemoveTarget removes an upstream target from the rotation
+func (b *balancer) RemoveTarget(name string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for i, t := range b.targets {
+		if t.Name == name {
+			b.targets = append(b.targets[:i:i], b.targets[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// Next returns the next available upstream target. The caller must call done
+// once the request to the target is over
+func (b *balancer) Next(c echo.Context) *middleware.ProxyTarget {
+	targets := b.available()
+	if len(targets) == 0 {
+		return nil
+	}
+
+	if s, ok := c.Request().Context().Value(retryContextKey).(*retryState); ok {
+		// Retries go to another target, if there is one
+		targets = s.untried(targets)
+	}
+
+	t := b.strategy.pick(c, targets)
+	atomic.AddInt64(&t.inflight, 1)
+	upstreamInFlight.WithLabelValues(b.name, t.Name).Inc()
+
+	return t.ProxyTarget
+}
+
+// done tells the balancer a request to the target is over
+func (b *balancer) done(name string) {
+	if t := b.target(name); t != nil {
+		atomic.AddInt64(&t.inflight, -1)
+		upstreamInFlight.WithLabelValues(b.name, name).Dec()
+	}
+}
+
+// available returns the targets in rotation. If none is, we'd rather try
+// all of them than refuse every request
+func (b *balancer) available() []*upstreamTarget {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	now := time.Now()
+	available := make([]*upstreamTarget, 0, len(b.targets))
+	for _, t := range b.targets {
+		if t.available(now) {
+			available = append(available, t)
+		}
+	}
+
+	if len(available) == 0 {
+		available = append(available, b.targets...)
+	}
+
+	return available
+}
+
+// all returns every target known to the balancer
+func (b *balancer) all() []*upstreamTarget {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	return append([]*upstreamTarget(nil), b.targets...)
+}
+
+// target returns the target with the given name, if the balancer knows it
+func (b *balancer) target(name string) *upstreamTarget {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	for _, t := range b.targets {
+		if t.Name == name {
+			return t
+		}
+	}
+
+	return nil
+}
@@ -2,18 +2,55 @@
 package services
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha256"
 	"fmt"
-	"hash"
 	"net/http"
 	"net/url"
 	"sort"
+	"strconv"
 	"time"
 
 	"github.com/mfamador/pistache/internal/datasources/caches"
 	"github.com/mfamador/pistache/internal/models"
 	"github.com/mfamador/pistache/internal/repos"
+	"github.com/mfamador/pistache/internal/requestid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/api/trace"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// Results of a lookup in a cache tier
+const (
+	lookupHit   = "hit"
+	lookupMiss  = "miss"
+	lookupStale = "stale"
+)
+
+// Results of storing a response in a cache tier
+const (
+	storeSuccess = "success"
+	storeFailure = "failure"
+)
+
+var (
+	cacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pistache_cache_lookups_total",
+		Help: "Number of lookups in a cache tier, by result: hit, miss or stale",
+	}, []string{"tier", "result"})
+	cacheStores = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pistache_cache_stores_total",
+		Help: "Number of responses stored in a cache tier, by result: success or failure",
+	}, []string{"tier", "result"})
+	cacheEntrySize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "pistache_cache_entry_size_bytes",
+		Help:    "Size of the response bodies stored in the cache",
+		Buckets: prometheus.ExponentialBuckets(256, 4, 10),
+	})
 )
 
 // CacheConfig contains the Cache service config options
@@ -26,7 +63,13 @@ type CacheConfig struct {
 		Error   int `yaml:"error"`
 	} `yaml:"ttl"`
 	ForwardingHeaders []string `yaml:"forwardingHeaders"`
-	Hash              struct {
+	SetCookie         string   `yaml:"setCookie" default:"skip"`
+	FetchHeadWithGet  bool     `yaml:"fetchHeadWithGet"`
+	StoredHeaders     struct {
+		Allow []string `yaml:"allow"`
+		Deny  []string `yaml:"deny"`
+	} `yaml:"storedHeaders"`
+	Hash struct {
 		Prefix       string `yaml:"prefix" default:"app"`
 		HashElements `yaml:",inline"`
 		Overrides    []struct {
@@ -34,20 +77,59 @@ type CacheConfig struct {
 			HashElements `yaml:",inline"`
 		} `yaml:"overrides"`
 	} `yaml:"hash"`
+	// KeyDebug explains the key of a request in a response header, if the
+	// request has the secret in the header
+	KeyDebug struct {
+		Header string `yaml:"header" default:"X-Pistache-Debug"`
+		Secret string `yaml:"secret" json:"-"`
+	} `yaml:"keyDebug"`
 }
 
 // HashElements details the elements used for computing a request hash key
 type HashElements struct {
-	UsePath     bool     `yaml:"usePath"`
-	Headers     []string `yaml:"headers"`
-	QueryParams []string `yaml:"queryParams"`
+	UsePath     bool     `yaml:"usePath" json:"usePath"`
+	Headers     []string `yaml:"headers" json:"headers"`
+	QueryParams []string `yaml:"queryParams" json:"queryParams"`
+	Cookies     []string `yaml:"cookies" json:"cookies"`
 }
 
+// Policies for responses carrying a Set-Cookie header
+const (
+	// SetCookieSkip refuses to cache the response
+	SetCookieSkip = "skip"
+	// SetCookieStrip caches the response without its Set-Cookie headers
+	SetCookieStrip = "strip"
+	// SetCookieStore caches the response as is
+	SetCookieStore = "store"
+)
+
+// Tiers a cached response can be fetched from
+const (
+	TierMemory = "memory"
+	TierRedis  = "redis"
+)
+
+const (
+	cookieHeader    = "Cookie"
+	setCookieHeader = "Set-Cookie"
+	ageHeader       = "Age"
+	rangeHeader     = "Range"
+	ifRangeHeader   = "If-Range"
+)
+
 // Cache defines a cache service
 type Cache interface {
 	GetCachedResponse(*http.Request) (string, *models.Response, error)
-	Store(string, *models.Response) bool
+	Store(context.Context, string, *models.Response) bool
 	Skip(*http.Request) bool
+	FetchHeadWithGet() bool
+	ExplainKey(*http.Request) (*KeyExplanation, error)
+	KeyDebug(*http.Request) bool
+	Keys(tier, prefix, cursor string, count int) (*KeyPage, error)
+	Entry(key string) (*Entry, error)
+	Stats() *Stats
+	Ping(context.Context) map[string]error
+	Close() error
 }
 
 type cache struct {
@@ -61,6 +143,12 @@ type cache struct {
 	methods           []string
 	overrides         map[string]HashElements
 	forwardingHeaders []string
+	setCookie         string
+	fetchHeadWithGet  bool
+	allowedHeaders    []string
+	deniedHeaders     []string
+	keyDebugHeader    string
+	keyDebugSecret    string
 }
 
 // NewCache creates a new Configs service
@@ -79,6 +167,24 @@ func NewCache(conf *CacheConfig) (Cache, error) {
 		exceptions:        conf.Exceptions,
 		methods:           conf.Methods,
 		forwardingHeaders: conf.ForwardingHeaders,
+		setCookie:         conf.SetCookie,
+		fetchHeadWithGet:  conf.FetchHeadWithGet,
+		allowedHeaders:    canonicalHeaderKeys(conf.StoredHeaders.Allow),
+		deniedHeaders:     canonicalHeaderKeys(conf.StoredHeaders.Deny),
+		keyDebugHeader:    conf.KeyDebug.Header,
+		keyDebugSecret:    conf.KeyDebug.Secret,
+	}
+	if c.keyDebugHeader == "" {
+		c.keyDebugHeader = defaultKeyDebugHeader
+	}
+	c.keyDebugHeader = http.CanonicalHeaderKey(c.keyDebugHeader)
+
+	switch c.setCookie {
+	case "":
+		c.setCookie = SetCookieSkip
+	case SetCookieSkip, SetCookieStrip, SetCookieStore:
+	default:
+		return nil, fmt.Errorf("invalid setCookie policy %q", c.setCookie)
 	}
 
 	for i, v := range c.hashElements.Headers {
@@ -105,16 +211,21 @@ func NewCache(conf *CacheConfig) (Cache, error) {
 }
 
 func (c *cache) GetCachedResponse(r *http.Request) (string, *models.Response, error) {
+	ctx := r.Context()
+
+	_, span := tracer.Start(ctx, "cache.key")
 	key, err := c.keyFromRequest(r)
 	if err != nil {
-		log.Warn().Err(err).Msg("Error creating key")
+		requestid.Logger(ctx).Warn().Err(err).Msg("Error creating key")
+		recordError(ctx, span, err)
 	}
+	span.End()
 
 	if err == nil {
 		// We have the key to the cache, let's get it!
-		cachedResponse, cerr := c.getFromCache(key)
+		cachedResponse, cerr := c.getFromCache(ctx, key)
 		if cerr != nil {
-			log.Warn().Err(cerr).Msg("Failed to get cached value")
+			requestid.Logger(ctx).Warn().Err(cerr).Msg("Failed to get cached value")
 		}
 		return key, cachedResponse, cerr
 	}
@@ -122,31 +233,79 @@ func (c *cache) GetCachedResponse(r *http.Request) (string, *models.Response, er
 	return key, nil, err
 }
 
-func (c *cache) getFromCache(s string) (*models.Response, error) {
-	resp, err := c.inMemory.Fetch(s)
-	if resp != nil || err != nil {
-		return resp, err
+func (c *cache) getFromCache(ctx context.Context, s string) (*models.Response, error) {
+	now := time.Now()
+
+	resp, err := fetch(ctx, TierMemory, c.inMemory, s, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp != nil {
+		return fetchedFrom(resp, TierMemory), nil
 	}
 
 	if c.redis != nil {
-		redisResp, err := c.redis.Fetch(s)
+		redisResp, err := fetch(ctx, TierRedis, c.redis, s, now)
 		if err != nil {
 			return nil, err
 		}
 
 		if redisResp != nil {
-			// store locally
-			c.inMemory.Store(s, redisResp, c.getTTL(redisResp.StatusCode))
-			return redisResp, nil
+			// store locally, for as long as it's still valid in Redis
+			ttl := c.getTTL(redisResp.StatusCode)
+			if !redisResp.ExpiresAt.IsZero() {
+				ttl = redisResp.TTL(now)
+			}
+			if ttl > 0 {
+				c.inMemory.Store(ctx, s, redisResp, ttl)
+			}
+			return fetchedFrom(redisResp, TierRedis), nil
 		}
 	}
 
 	return nil, nil
 }
 
+// fetch looks a key up in a tier, dropping an expired entry the tier didn't
+// evict yet
+func fetch(ctx context.Context, tier string, repo repos.Cache, key string, now time.Time) (*models.Response, error) {
+	ctx, span := tracer.Start(ctx, "cache.fetch", trace.WithAttributes(tierLabel.String(tier)))
+	defer span.End()
+
+	resp, err := repo.Fetch(ctx, key)
+	if err != nil {
+		recordError(ctx, span, err)
+		return nil, err
+	}
+
+	result := lookupHit
+	switch {
+	case resp == nil:
+		result = lookupMiss
+	case !resp.ExpiresAt.IsZero() && !now.Before(resp.ExpiresAt):
+		result = lookupStale
+		resp = nil
+	}
+
+	cacheLookups.WithLabelValues(tier, result).Inc()
+	span.SetAttributes(resultLabel.String(result))
+
+	return resp, nil
+}
+
+// fetchedFrom returns a shallow copy of a cached response tagged with its tier,
+// so the stored entry itself is never modified
+func fetchedFrom(resp *models.Response, tier string) *models.Response {
+	fetched := *resp
+	fetched.Tier = tier
+
+	return &fetched
+}
+
 // keyFromRequest returns the cache key for a request
-// Key is the SHA-256 hash of the Method, Host, Path, Query fields and
-// configured headers
+// Key is the SHA-256 hash of the Method (HEAD shares the GET key), Host, Path, Query fields,
+// configured headers and configured cookies
 // represented in lowercase hexadecimal string
 func (c *cache) keyFromRequest(req *http.Request) (string, error) {
 	return c.getKey(req, c.getHashElements(req))
@@ -156,7 +315,7 @@ func (c *cache) getURL(req *http.Request) (*url.URL, error) {
 	for _, v := range c.forwardingHeaders {
 		val := req.Header.Get(v)
 		if val != "" {
-			log.Debug().Str("val", val).Msg("Change to new URL")
+			requestid.Logger(req.Context()).Debug().Str("val", val).Msg("Change to new URL")
 			return url.Parse(fmt.Sprintf("http://%s%s", req.URL.Host, val))
 		}
 	}
@@ -165,55 +324,102 @@ func (c *cache) getURL(req *http.Request) (*url.URL, error) {
 }
 
 func (c *cache) getKey(req *http.Request, elems HashElements) (string, error) {
-	reqURL, err := c.getURL(req)
+	reqURL, canonical, err := c.canonicalRequest(req, elems)
 	if err != nil {
 		return "", err
 	}
 
-	h := sha256.New()
+	key := c.hashKey(canonical)
 
-	if _, err := h.Write([]byte(req.Method)); err != nil {
-		return "", err
-	}
+	requestid.Logger(req.Context()).Debug().
+		Str("key", key).
+		Interface("elems", elems).
+		Str("method", req.Method).
+		Str("host", req.Host).
+		Str("originalPath", req.URL.Path).
+		Str("originalQuery", req.URL.RawQuery).
+		Str("path", reqURL.Path).
+		Str("query", reqURL.RawQuery).
+		Interface("headers", req.Header).
+		Msg("keyFromRequest")
 
-	if _, err := h.Write([]byte(req.Host)); err != nil {
-		return "", err
+	return key, nil
+}
+
+// hashKey returns the key of a canonical request
+func (c *cache) hashKey(canonical []byte) string {
+	return fmt.Sprintf("{%s}-%x-", c.prefix, sha256.Sum256(canonical))
+}
+
+// canonicalRequest returns the URL used for the key of a request, and the
+// string hashed into the key
+func (c *cache) canonicalRequest(req *http.Request, elems HashElements) (*url.URL, []byte, error) {
+	reqURL, err := c.getURL(req)
+	if err != nil {
+		return nil, nil, err
 	}
 
+	logger := requestid.Logger(req.Context())
+	var b bytes.Buffer
+
+	b.WriteString(keyMethod(req))
+	b.WriteString(req.Host)
+
 	if elems.UsePath {
-		if _, err := h.Write([]byte(reqURL.Path)); err != nil {
-			return "", err
-		}
+		b.WriteString(reqURL.Path)
 	}
 
 	queryMap := map[string][]string(reqURL.Query())
-	if err := hashWriteMap(h, queryMap, elems.QueryParams); err != nil {
-		return "", err
+	hashWriteMap(logger, &b, queryMap, elems.QueryParams)
+	hashWriteMap(logger, &b, c.keyHeaders(req, elems), elems.Headers)
+
+	if len(elems.Cookies) > 0 {
+		cookieMap := make(map[string][]string)
+		for _, v := range req.Cookies() {
+			cookieMap[v.Name] = append(cookieMap[v.Name], v.Value)
+		}
+		hashWriteMap(logger, &b, cookieMap, elems.Cookies)
 	}
 
-	headerMap := map[string][]string(req.Header)
-	if err := hashWriteMap(h, headerMap, elems.Headers); err != nil {
-		return "", err
+	return reqURL, b.Bytes(), nil
+}
+
+// keyMethod returns the method used in the key. HEAD requests are served
+// from the GET entries
+func keyMethod(req *http.Request) string {
+	if req.Method == http.MethodHead {
+		return http.MethodGet
 	}
 
-	key := fmt.Sprintf("%x", h.Sum(nil))
+	return req.Method
+}
 
-	log.Debug().
-		Str("key", key).
-		Interface("elems", elems).
-		Str("method", req.Method).
-		Str("host", req.Host).
-		Str("originalPath", req.URL.Path).
-		Str("originalQuery", req.URL.RawQuery).
-		Str("path", reqURL.Path).
-		Str("query", reqURL.RawQuery).
-		Interface("headers", req.Header).
-		Msg("keyFromRequest")
+// keyHeaders returns the request headers that may be part of the key.
+// Ranges are served from the full cached response, so they never are, and
+// neither are the headers identifying a single request or asking for the
+// key to be explained
+func (c *cache) keyHeaders(req *http.Request, elems HashElements) map[string][]string {
+	headerMap := make(map[string][]string, len(req.Header))
+	for k, v := range req.Header {
+		// The named cookies are hashed on their own, so the raw Cookie header
+		// must not make every session unique
+		if k == cookieHeader && len(elems.Cookies) > 0 {
+			continue
+		}
+		if k == rangeHeader || k == ifRangeHeader {
+			continue
+		}
+		// Every request has its own ID and trace
+		if contains(k, perRequestHeaders) || k == c.keyDebugHeader {
+			continue
+		}
+		headerMap[k] = v
+	}
 
-	return fmt.Sprintf("{%s}-%s-", c.prefix, key), nil
+	return headerMap
 }
 
-func hashWriteMap(h hash.Hash, m map[string][]string, keys []string) error {
+func hashWriteMap(logger *zerolog.Logger, b *bytes.Buffer, m map[string][]string, keys []string) {
 	if len(keys) == 0 {
 		// If we want all the keys, we have to sort them first, so we get the same
 		// hash all every time
@@ -231,14 +437,10 @@ func hashWriteMap(h hash.Hash, m map[string][]string, keys []string) error {
 		v, ok := m[k]
 		if ok {
 			val := fmt.Sprintf("%s=%s", k, v[0])
-			log.Debug().Str("val", val).Msg("hashWriteMap")
-			if _, err := h.Write([]byte(val)); err != nil {
-				return err
-			}
+			logger.Debug().Str("val", val).Msg("hashWriteMap")
+			b.WriteString(val)
 		}
 	}
-
-	return nil
 }
 
 func (c *cache) getHashElements(req *http.Request) HashElements {
@@ -250,15 +452,86 @@ func (c *cache) getHashElements(req *http.Request) HashElements {
 	return c.hashElements
 }
 
-// Store caches a response locally and in Redis
-func (c *cache) Store(s string, response *models.Response) bool {
+// Store caches a response locally and in Redis. The context only carries
+// the trace and the ID of the request
+func (c *cache) Store(ctx context.Context, s string, response *models.Response) bool {
+	if response.StatusCode == http.StatusPartialContent {
+		// A partial response is not the full representation we serve ranges from
+		requestid.Logger(ctx).Debug().Str("key", s).Msg("Not caching partial response")
+		return false
+	}
+
+	if _, ok := response.Header[setCookieHeader]; ok && c.setCookie == SetCookieSkip {
+		requestid.Logger(ctx).Debug().Str("key", s).Msg("Not caching response with Set-Cookie")
+		return false
+	}
+
 	ttl := c.getTTL(response.StatusCode)
+	if ttl <= 0 {
+		// The entry would be stale right away, and never evicted by the tiers
+		requestid.Logger(ctx).Debug().Str("key", s).Msg("Not caching response without TTL")
+		return false
+	}
+
+	stored := *response
+	stored.Header = c.storedHeader(response.Header)
+	stored.StoredAt = time.Now()
+	stored.ExpiresAt = stored.StoredAt.Add(ttl)
+	if age, err := strconv.ParseInt(http.Header(response.Header).Get(ageHeader), 10, 64); err == nil && age > 0 {
+		stored.InitialAge = age
+	}
 
-	if c.redis != nil && !c.redis.Store(s, response, ttl) {
+	cacheEntrySize.Observe(float64(len(stored.Body)))
+
+	if c.redis != nil && !store(ctx, TierRedis, c.redis, s, &stored, ttl) {
+		return false
+	}
+
+	return store(ctx, TierMemory, c.inMemory, s, &stored, ttl)
+}
+
+// store stores a response in a tier
+func store(ctx context.Context, tier string, repo repos.Cache, key string, response *models.Response, ttl time.Duration) bool {
+	ctx, span := tracer.Start(ctx, "cache.store", trace.WithAttributes(tierLabel.String(tier)))
+	defer span.End()
+
+	result := storeSuccess
+	ok := repo.Store(ctx, key, response, ttl)
+	if !ok {
+		result = storeFailure
+		span.SetStatus(codes.Error, "failed to store the response")
+	}
+	cacheStores.WithLabelValues(tier, result).Inc()
+
+	return ok
+}
+
+// storedHeader returns a copy of the response headers we are allowed to store
+func (c *cache) storedHeader(header map[string][]string) map[string][]string {
+	stored := make(map[string][]string, len(header))
+	for k, v := range header {
+		if c.storesHeader(k) {
+			stored[k] = append([]string(nil), v...)
+		}
+	}
+
+	return stored
+}
+
+func (c *cache) storesHeader(name string) bool {
+	if name == setCookieHeader && c.setCookie == SetCookieStrip {
+		return false
+	}
+
+	if contains(name, perResponseHeaders) || contains(name, hopByHopHeaders) {
 		return false
 	}
 
-	return c.inMemory.Store(s, response, ttl)
+	if len(c.allowedHeaders) > 0 && !contains(name, c.allowedHeaders) {
+		return false
+	}
+
+	return !contains(name, c.deniedHeaders)
 }
 
 func (c *cache) getTTL(statusCode int) time.Duration {
@@ -271,9 +544,10 @@ func (c *cache) getTTL(statusCode int) time.Duration {
 
 // Skip determines if a request should skip the cache altogether
 func (c *cache) Skip(req *http.Request) bool {
-	pistached := contains(req.Method, c.methods) && !contains(req.RequestURI, c.exceptions)
+	// Upgrades and event streams are passed through as they are
+	pistached := contains(req.Method, c.methods) && !contains(req.RequestURI, c.exceptions) && !isStreamingRequest(req)
 
-	log.Debug().
+	requestid.Logger(req.Context()).Debug().
 		Str("request", req.RequestURI).
 		Interface("methods", c.methods).
 		Interface("exceptions", c.exceptions).
@@ -285,6 +559,12 @@ func (c *cache) Skip(req *http.Request) bool {
 	return !pistached
 }
 
+// FetchHeadWithGet tells if a HEAD miss should be fetched with a GET, so its
+// response can populate the cache
+func (c *cache) FetchHeadWithGet() bool {
+	return c.fetchHeadWithGet
+}
+
 func contains(str string, slice []string) bool {
 	for _, p := range slice {
 		if p == str {
@@ -293,3 +573,15 @@ func contains(str string, slice []string) bool {
 	}
 	return false
 }
+
+// Close closes the connections of every tier
+func (c *cache) Close() error {
+	var err error
+	for _, t := range c.tiers() {
+		if closeErr := t.repo.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("closing the %s tier: %w", t.name, closeErr)
+		}
+	}
+
+	return err
+}
@@ -1,9 +1,13 @@
 package services_test
 
 import (
+	"context"
+	"errors"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/mfamador/pistache/internal/models"
 
@@ -92,7 +96,7 @@ var _ = Describe("Cache service", func() {
 		key, _, err := s.GetCachedResponse(sucessRequest)
 		Expect(err).ToNot(HaveOccurred())
 
-		success := s.Store(key, sucessResponse)
+		success := s.Store(context.Background(), key, sucessResponse)
 		Expect(err).ToNot(HaveOccurred())
 		Expect(success).To(BeTrue())
 
@@ -112,6 +116,114 @@ var _ = Describe("Cache service", func() {
 			Msg("Response")
 	})
 
+	It("should tell the tier and expiry of a cached response", func() {
+		key, _, err := s.GetCachedResponse(sucessRequest)
+		Expect(err).ToNot(HaveOccurred())
+
+		aged := &models.Response{
+			StatusCode: http.StatusOK,
+			Header:     map[string][]string{"Age": {"30"}},
+		}
+		Expect(s.Store(context.Background(), key, aged)).To(BeTrue())
+
+		var response *models.Response
+		Eventually(func() *models.Response {
+			_, response, _ = s.GetCachedResponse(sucessRequest)
+			return response
+		}).ShouldNot(BeNil())
+
+		Expect(response.Tier).To(Equal(services.TierMemory))
+		Expect(response.Age(time.Now())).To(BeNumerically(">=", 30*time.Second))
+		Expect(response.TTL(time.Now())).To(BeNumerically("~", 2*time.Second, time.Second))
+	})
+
+	It("should count lookups and stores by tier", func() {
+		hit := map[string]string{"tier": services.TierMemory, "result": "hit"}
+		miss := map[string]string{"tier": services.TierMemory, "result": "miss"}
+		stored := map[string]string{"tier": services.TierMemory, "result": "success"}
+		hits, misses, stores := metricValue("pistache_cache_lookups_total", hit),
+			metricValue("pistache_cache_lookups_total", miss),
+			metricValue("pistache_cache_stores_total", stored)
+
+		request, err := http.NewRequest(http.MethodGet, "/metrics-test", nil)
+		Expect(err).ToNot(HaveOccurred())
+		key, _, err := s.GetCachedResponse(request)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(metricValue("pistache_cache_lookups_total", miss)).To(Equal(misses + 1))
+
+		Expect(s.Store(context.Background(), key, sucessResponse)).To(BeTrue())
+		Expect(metricValue("pistache_cache_stores_total", stored)).To(Equal(stores + 1))
+
+		Eventually(func() *models.Response {
+			_, response, _ := s.GetCachedResponse(request)
+			return response
+		}).ShouldNot(BeNil())
+		Expect(metricValue("pistache_cache_lookups_total", hit)).To(BeNumerically(">", hits))
+	})
+
+	It("should trace the lookups and stores of each tier", func() {
+		spans.Reset()
+
+		request, err := http.NewRequest(http.MethodGet, "/tracing-test", nil)
+		Expect(err).ToNot(HaveOccurred())
+		key, _, err := s.GetCachedResponse(request)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(s.Store(context.Background(), key, sucessResponse)).To(BeTrue())
+
+		Expect(spanNames()).To(ContainElements("cache.key", "cache.fetch", "cache.store"))
+	})
+
+	It("should not use Range headers in the key", func() {
+		rangeRequest, err := http.NewRequest(http.MethodGet, "/dummy", nil)
+		Expect(err).ToNot(HaveOccurred())
+		rangeRequest.Header.Set("Range", "bytes=0-10")
+
+		key1, _, err := s.GetCachedResponse(sucessRequest)
+		Expect(err).ToNot(HaveOccurred())
+		key2, _, err := s.GetCachedResponse(rangeRequest)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(key1).To(Equal(key2))
+	})
+
+	It("should not use the request ID or trace context in the key", func() {
+		tracedRequest, err := http.NewRequest(http.MethodGet, "/dummy", nil)
+		Expect(err).ToNot(HaveOccurred())
+		tracedRequest.Header.Set("X-Request-Id", "abc")
+		tracedRequest.Header.Set("Traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+
+		key1, _, err := s.GetCachedResponse(sucessRequest)
+		Expect(err).ToNot(HaveOccurred())
+		key2, _, err := s.GetCachedResponse(tracedRequest)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(key1).To(Equal(key2))
+	})
+
+	It("should share the key between HEAD and GET", func() {
+		headRequest, err := http.NewRequest(http.MethodHead, "/dummy", nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		key1, _, err := s.GetCachedResponse(sucessRequest)
+		Expect(err).ToNot(HaveOccurred())
+		key2, _, err := s.GetCachedResponse(headRequest)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(key1).To(Equal(key2))
+	})
+
+	It("should not cache a partial response", func() {
+		partial := &models.Response{StatusCode: http.StatusPartialContent}
+		Expect(s.Store(context.Background(), "{test}-partial-", partial)).To(BeFalse())
+	})
+
+	It("should not cache a response without TTL", func() {
+		conf := *cf
+		conf.TTL.Error = 0
+		noErrorTTL, err := services.NewCache(&conf)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(noErrorTTL.Store(context.Background(), "{test}-error-", errorResponse)).To(BeFalse())
+		Expect(noErrorTTL.Store(context.Background(), "{test}-success-", sucessResponse)).To(BeTrue())
+	})
+
 	It("should skip a POST", func() {
 		skip := s.Skip(postRequest)
 		Expect(skip).To(BeTrue())
@@ -128,4 +240,270 @@ var _ = Describe("Cache service", func() {
 		Expect(strings.HasPrefix(key, "{test}-")).To(BeTrue())
 	})
 
+	Context("with streaming requests", func() {
+		BeforeEach(func() {
+			conf := *cf
+			conf.Methods = []string{http.MethodGet}
+			s, err = services.NewCache(&conf)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("should skip event streams and upgrades", func() {
+			sse := httptest.NewRequest(http.MethodGet, "/events", nil)
+			sse.Header.Set("Accept", "text/event-stream")
+			Expect(s.Skip(sse)).To(BeTrue())
+
+			upgrade := httptest.NewRequest(http.MethodGet, "/socket", nil)
+			upgrade.Header.Set("Connection", "keep-alive, Upgrade")
+			upgrade.Header.Set("Upgrade", "websocket")
+			Expect(s.Skip(upgrade)).To(BeTrue())
+
+			Expect(s.Skip(httptest.NewRequest(http.MethodGet, "/dummy", nil))).To(BeFalse())
+		})
+	})
+
+	Context("with cookies in the key", func() {
+		cookieRequest := func(cookie string) *http.Request {
+			r, err := http.NewRequest(http.MethodGet, "/dummy", nil)
+			Expect(err).ToNot(HaveOccurred())
+			r.Header.Set("Cookie", cookie)
+			return r
+		}
+
+		BeforeEach(func() {
+			conf := *cf
+			conf.Hash.Cookies = []string{"tenant"}
+			s, err = services.NewCache(&conf)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("should ignore cookies that are not configured", func() {
+			key1, _, err := s.GetCachedResponse(cookieRequest("tenant=a; session=1"))
+			Expect(err).ToNot(HaveOccurred())
+			key2, _, err := s.GetCachedResponse(cookieRequest("session=2; tenant=a"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(key1).To(Equal(key2))
+		})
+
+		It("should use the configured cookies", func() {
+			key1, _, err := s.GetCachedResponse(cookieRequest("tenant=a"))
+			Expect(err).ToNot(HaveOccurred())
+			key2, _, err := s.GetCachedResponse(cookieRequest("tenant=b"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(key1).ToNot(Equal(key2))
+		})
+	})
+
+	Context("explaining keys", func() {
+		BeforeEach(func() {
+			conf := *cf
+			conf.Hash.Overrides = make([]struct {
+				OriginalPath          string `yaml:"originalPath"`
+				services.HashElements `yaml:",inline"`
+			}, 1)
+			conf.Hash.Overrides[0].OriginalPath = "/explained"
+			conf.Hash.Overrides[0].QueryParams = []string{"q"}
+			conf.KeyDebug.Secret = "secret"
+			s, err = services.NewCache(&conf)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("should explain the key and where it's cached", func() {
+			r, err := http.NewRequest(http.MethodGet, "http://example.com/explained?q=1&other=2", nil)
+			Expect(err).ToNot(HaveOccurred())
+			r.Header.Set("X-Pistache-Debug", "secret")
+
+			key, _, err := s.GetCachedResponse(r)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(s.Store(context.Background(), key, sucessResponse)).To(BeTrue())
+
+			var e *services.KeyExplanation
+			Eventually(func() []services.TierPresence {
+				e, err = s.ExplainKey(r)
+				Expect(err).ToNot(HaveOccurred())
+				return e.Tiers
+			}).Should(ConsistOf(services.TierPresence{Tier: services.TierMemory, Present: true, TTL: 1}))
+			Expect(e.Key).To(Equal(key))
+			Expect(e.Override).To(Equal("/explained"))
+			Expect(e.HashElements.QueryParams).To(Equal([]string{"q"}))
+			Expect(e.URL).To(Equal("http://example.com/explained?q=1&other=2"))
+			// The secret isn't part of the key
+			Expect(e.Canonical).To(Equal("GETexample.comq=1"))
+		})
+
+		It("should only explain the key to requests with the secret", func() {
+			r, err := http.NewRequest(http.MethodGet, "/explained", nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(s.KeyDebug(r)).To(BeFalse())
+
+			r.Header.Set("X-Pistache-Debug", "secret")
+			Expect(s.KeyDebug(r)).To(BeTrue())
+			Expect(r.Header).ToNot(HaveKey("X-Pistache-Debug"))
+		})
+	})
+
+	Context("inspecting the cache", func() {
+		store := func(key string, resp *models.Response) {
+			Expect(s.Store(context.Background(), key, resp)).To(BeTrue())
+			Eventually(func() *services.Entry {
+				e, err := s.Entry(key)
+				Expect(err).ToNot(HaveOccurred())
+				return e
+			}).ShouldNot(BeNil())
+		}
+
+		It("should list the keys by prefix a page at a time", func() {
+			for _, key := range []string{"{inspect}-c-", "{inspect}-a-", "{inspect}-b-", "{other}-a-"} {
+				store(key, sucessResponse)
+			}
+
+			page, err := s.Keys(services.TierMemory, "{inspect}-", "", 2)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(page.Keys).To(Equal([]string{"{inspect}-a-", "{inspect}-b-"}))
+			Expect(page.Cursor).ToNot(BeEmpty())
+
+			page, err = s.Keys(services.TierMemory, "{inspect}-", page.Cursor, 2)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(page.Keys).To(Equal([]string{"{inspect}-c-"}))
+			Expect(page.Cursor).To(BeEmpty())
+		})
+
+		It("should refuse a tier that isn't configured", func() {
+			_, err := s.Keys(services.TierRedis, "", "", 0)
+			Expect(errors.Is(err, services.ErrUnknownTier)).To(BeTrue())
+		})
+
+		It("should describe an entry", func() {
+			store("{inspect}-entry-", &models.Response{
+				StatusCode: http.StatusOK,
+				Header:     map[string][]string{"Cache-Tag": {"a, b"}, "Surrogate-Key": {"c d"}},
+				Body:       []byte("body"),
+			})
+
+			e, err := s.Entry("{inspect}-entry-")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(e.StatusCode).To(Equal(http.StatusOK))
+			Expect(e.Size).To(Equal(4))
+			Expect(e.Tags).To(Equal([]string{"a", "b", "c", "d"}))
+			Expect(e.StoredAt).ToNot(BeZero())
+			Expect(e.TTL).To(BeNumerically("<=", 2))
+			Expect(e.Tiers).To(ConsistOf(services.TierPresence{Tier: services.TierMemory, Present: true, TTL: e.TTL}))
+
+			e, err = s.Entry("{inspect}-missing-")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(e).To(BeNil())
+		})
+
+		It("should report the size and use of the tiers", func() {
+			store("{inspect}-stats-", &models.Response{StatusCode: http.StatusOK, Body: []byte("12345")})
+
+			stats := s.Stats()
+			Expect(stats.Tiers).To(HaveLen(1))
+			Expect(stats.Tiers[0].Tier).To(Equal(services.TierMemory))
+			Expect(stats.Tiers[0].Entries).To(BeNumerically(">=", 1))
+			Expect(stats.Tiers[0].Bytes).To(BeNumerically(">=", 5))
+			Expect(stats.Tiers[0].Stores).To(HaveKeyWithValue("success", BeNumerically(">=", 1)))
+		})
+	})
+
+	Context("with a Set-Cookie response", func() {
+		cookieResponse := func() *models.Response {
+			return &models.Response{
+				StatusCode: http.StatusOK,
+				Header: map[string][]string{
+					"Set-Cookie":   {"session=1"},
+					"Content-Type": {"text/plain"},
+				},
+			}
+		}
+
+		It("should not cache it by default", func() {
+			Expect(s.Store(context.Background(), "{test}-set-cookie-skip-", cookieResponse())).To(BeFalse())
+		})
+
+		It("should cache it without Set-Cookie when stripping", func() {
+			conf := *cf
+			conf.SetCookie = services.SetCookieStrip
+			s, err = services.NewCache(&conf)
+			Expect(err).ToNot(HaveOccurred())
+
+			key, _, err := s.GetCachedResponse(sucessRequest)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(s.Store(context.Background(), key, cookieResponse())).To(BeTrue())
+
+			Eventually(func() *models.Response {
+				_, response, _ := s.GetCachedResponse(sucessRequest)
+				return response
+			}).ShouldNot(BeNil())
+
+			_, response, _ := s.GetCachedResponse(sucessRequest)
+			Expect(response.Header).ToNot(HaveKey("Set-Cookie"))
+			Expect(response.Header).To(HaveKey("Content-Type"))
+		})
+
+		It("should refuse an unknown policy", func() {
+			conf := *cf
+			conf.SetCookie = "keep"
+			_, err = services.NewCache(&conf)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("with stored headers", func() {
+		headerResponse := func() *models.Response {
+			return &models.Response{
+				StatusCode: http.StatusOK,
+				Header: map[string][]string{
+					"Content-Type":      {"text/plain"},
+					"Vary":              {"Accept", "Accept-Encoding"},
+					"Date":              {"Mon, 02 Jan 2006 15:04:05 GMT"},
+					"X-Pistache":        {"miss"},
+					"Transfer-Encoding": {"chunked"},
+					"X-Internal":        {"secret"},
+				},
+			}
+		}
+
+		storeAndFetch := func(conf *services.CacheConfig) *models.Response {
+			s, err = services.NewCache(conf)
+			Expect(err).ToNot(HaveOccurred())
+
+			key, _, err := s.GetCachedResponse(sucessRequest)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(s.Store(context.Background(), key, headerResponse())).To(BeTrue())
+
+			var response *models.Response
+			Eventually(func() *models.Response {
+				_, response, _ = s.GetCachedResponse(sucessRequest)
+				return response
+			}).ShouldNot(BeNil())
+
+			return response
+		}
+
+		It("should keep multiple values and drop per-response headers", func() {
+			response := storeAndFetch(cf)
+			Expect(response.Header["Vary"]).To(Equal([]string{"Accept", "Accept-Encoding"}))
+			Expect(response.Header).ToNot(HaveKey("Date"))
+			Expect(response.Header).ToNot(HaveKey("X-Pistache"))
+			Expect(response.Header).ToNot(HaveKey("Transfer-Encoding"))
+			Expect(response.StoredAt.IsZero()).To(BeFalse())
+		})
+
+		It("should drop denied headers", func() {
+			conf := *cf
+			conf.StoredHeaders.Deny = []string{"x-internal"}
+			response := storeAndFetch(&conf)
+			Expect(response.Header).ToNot(HaveKey("X-Internal"))
+			Expect(response.Header).To(HaveKey("Content-Type"))
+		})
+
+		It("should only keep allowed headers", func() {
+			conf := *cf
+			conf.StoredHeaders.Allow = []string{"Content-Type"}
+			response := storeAndFetch(&conf)
+			Expect(response.Header).To(HaveLen(1))
+			Expect(response.Header).To(HaveKey("Content-Type"))
+		})
+	})
 })
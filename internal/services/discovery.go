@@ -0,0 +1,273 @@
+// Package services has the dynamic upstream discovery
+package services
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	defaultDiscoveryInterval     = 30
+	defaultDiscoveryFileInterval = 2
+	discoveryLookupTimeout       = 5 * time.Second
+)
+
+// DiscoveryConfig contains the dynamic upstream discovery options of a pool.
+// Discovered upstreams are added to the ones set in the config
+type DiscoveryConfig struct {
+	// DNS resolves the upstreams from a DNS name
+	DNS *DNSDiscoveryConfig `yaml:"dns"`
+	// File is a YAML file listing upstreams, with the same fields as in the
+	// config. It's reloaded when it changes
+	File string `yaml:"file"`
+	// Interval between resolutions, in seconds
+	Interval int `yaml:"interval"`
+	// FileInterval between checks of the file for changes, in seconds
+	FileInterval int `yaml:"fileInterval"`
+}
+
+// DNSDiscoveryConfig contains the options to resolve upstreams from DNS
+type DNSDiscoveryConfig struct {
+	// Name to resolve
+	Name string `yaml:"name"`
+	// SRV resolves SRV records, which give the port and weight of every
+	// upstream. Otherwise A and AAAA records are resolved
+	SRV bool `yaml:"srv"`
+	// Port of the upstreams resolved from A and AAAA records
+	Port int `yaml:"port"`
+	// Scheme of the resolved upstreams, either http or https
+	Scheme string `yaml:"scheme"`
+}
+
+// discovery keeps the targets of a balancer in sync with the discovered
+// upstreams. Targets in the config are never removed. The sources are
+// refreshed independently, each keeping its last upstreams when it fails
+type discovery struct {
+	conf     DiscoveryConfig
+	balancer *balancer
+	// mu guards the upstreams of the sources and the discovered targets
+	mu sync.Mutex
+	// discovered are the names of the targets added by the discovery
+	discovered    map[string]bool
+	dnsUpstreams  []Upstream
+	fileMod       time.Time
+	fileUpstreams []Upstream
+	stop          chan struct{}
+}
+
+func newDiscovery(conf DiscoveryConfig, b *balancer) (*discovery, error) {
+	if conf.DNS == nil && conf.File == "" {
+		return nil, errors.New("upstream discovery needs either dns or file")
+	}
+	if conf.DNS != nil && conf.DNS.Name == "" {
+		return nil, errors.New("upstream discovery needs a dns name")
+	}
+	if conf.Interval <= 0 {
+		conf.Interval = defaultDiscoveryInterval
+	}
+	if conf.FileInterval <= 0 {
+		conf.FileInterval = defaultDiscoveryFileInterval
+	}
+
+	return &discovery{
+		conf:       conf,
+		balancer:   b,
+		discovered: make(map[string]bool),
+		stop:       make(chan struct{}),
+	}, nil
+}
+
+// Start resolves the upstreams until the discovery is stopped
+func (d *discovery) Start() {
+	var wg sync.WaitGroup
+	if d.conf.DNS != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.poll(d.conf.Interval, d.refreshDNS)
+		}()
+	}
+	if d.conf.File != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.poll(d.conf.FileInterval, d.refreshFile)
+		}()
+	}
+
+	wg.Wait()
+}
+
+// poll refreshes a source every interval, in seconds, until the discovery is
+// stopped
+func (d *discovery) poll(interval int, refresh func()) {
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			refresh()
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// Stop stops resolving the upstreams
+func (d *discovery) Stop() {
+	close(d.stop)
+}
+
+// refresh refreshes every source
+func (d *discovery) refresh() {
+	if d.conf.DNS != nil {
+		d.refreshDNS()
+	}
+	if d.conf.File != "" {
+		d.refreshFile()
+	}
+}
+
+// refreshDNS resolves the upstreams and updates the balancer. If the
+// resolution fails, the last resolved upstreams are kept
+func (d *discovery) refreshDNS() {
+	resolved, err := d.resolveDNS()
+	if err != nil {
+		log.Error().Err(err).Str("pool", d.balancer.name).Str("name", d.conf.DNS.Name).Msg("Failed to resolve upstreams")
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dnsUpstreams = resolved
+	d.update()
+}
+
+// refreshFile reloads the upstreams of the file and updates the balancer. If
+// the file can't be loaded, the last loaded upstreams are kept
+func (d *discovery) refreshFile() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.loadFile(); err != nil {
+		log.Error().Err(err).Str("pool", d.balancer.name).Str("file", d.conf.File).Msg("Failed to load upstreams")
+		return
+	}
+	d.update()
+}
+
+func (d *discovery) resolveDNS() ([]Upstream, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), discoveryLookupTimeout)
+	defer cancel()
+
+	conf := d.conf.DNS
+	if conf.SRV {
+		_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", conf.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		upstreams := make([]Upstream, len(records))
+		for i, r := range records {
+			upstreams[i] = Upstream{
+				Host:   strings.TrimSuffix(r.Target, "."),
+				Port:   int(r.Port),
+				Weight: int(r.Weight),
+				Scheme: conf.Scheme,
+			}
+		}
+
+		return upstreams, nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupHost(ctx, conf.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(addrs)
+	upstreams := make([]Upstream, len(addrs))
+	for i, addr := range addrs {
+		upstreams[i] = Upstream{Host: addr, Port: conf.Port, Scheme: conf.Scheme}
+	}
+
+	return upstreams, nil
+}
+
+// loadFile reads the upstreams of the file, if it changed since the last load
+func (d *discovery) loadFile() error {
+	info, err := os.Stat(d.conf.File)
+	if err != nil {
+		return err
+	}
+
+	if info.ModTime().Equal(d.fileMod) {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(d.conf.File)
+	if err != nil {
+		return err
+	}
+
+	var upstreams []Upstream
+	if err := yaml.Unmarshal(data, &upstreams); err != nil {
+		return err
+	}
+	d.fileMod = info.ModTime()
+	d.fileUpstreams = upstreams
+
+	return nil
+}
+
+// update adds the new upstreams of the sources to the balancer and removes the
+// ones that are gone. Requests in flight to a removed target carry on
+func (d *discovery) update() {
+	upstreams := append(append([]Upstream{}, d.dnsUpstreams...), d.fileUpstreams...)
+	current := make(map[string]bool, len(upstreams))
+	for _, upstream := range upstreams {
+		u, err := upstream.URL()
+		if err != nil {
+			log.Error().Err(err).Str("pool", d.balancer.name).Msg("Ignoring discovered upstream")
+			continue
+		}
+
+		name := upstream.Name()
+		current[name] = true
+		if d.discovered[name] {
+			continue
+		}
+
+		target := &middleware.ProxyTarget{Name: name, URL: u, Meta: echo.Map{"weight": upstream.Weight}}
+		if d.balancer.AddTarget(target) {
+			d.discovered[name] = true
+			log.Info().Str("pool", d.balancer.name).Str("upstream", name).Msg("Discovered upstream")
+		}
+	}
+
+	for name := range d.discovered {
+		if current[name] {
+			continue
+		}
+
+		d.balancer.RemoveTarget(name)
+		delete(d.discovered, name)
+		upstreamHealthy.DeleteLabelValues(d.balancer.name, name)
+		upstreamEjected.DeleteLabelValues(d.balancer.name, name)
+		upstreamInFlight.DeleteLabelValues(d.balancer.name, name)
+		log.Info().Str("pool", d.balancer.name).Str("upstream", name).Msg("Removed upstream")
+	}
+}
@@ -0,0 +1,69 @@
+// Package services has the explanation of cache keys
+package services
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"time"
+)
+
+const defaultKeyDebugHeader = "X-Pistache-Debug"
+
+// KeyExplanation details how the cache key of a request is computed, and
+// where the key is cached
+type KeyExplanation struct {
+	// HashElements are the elements of the request making up the key
+	HashElements HashElements `json:"hashElements"`
+	// Override is the original path of the override giving the elements, if
+	// one matched
+	Override string `json:"override,omitempty"`
+	// URL is the URL the key is computed from, after the forwarding headers
+	URL string `json:"url"`
+	// Canonical is the string hashed into the key
+	Canonical string `json:"canonical"`
+	Key       string `json:"key"`
+	// Tiers tells which tiers have the key
+	Tiers []TierPresence `json:"tiers"`
+}
+
+// ExplainKey explains the key of a request. The lookups in the tiers aren't
+// counted in the metrics
+func (c *cache) ExplainKey(req *http.Request) (*KeyExplanation, error) {
+	elems := c.getHashElements(req)
+	reqURL, canonical, err := c.canonicalRequest(req, elems)
+	if err != nil {
+		return nil, err
+	}
+
+	key := c.hashKey(canonical)
+	e := &KeyExplanation{
+		HashElements: elems,
+		URL:          reqURL.String(),
+		Canonical:    string(canonical),
+		Key:          key,
+	}
+	if _, ok := c.overrides[req.URL.Path]; ok {
+		e.Override = req.URL.Path
+	}
+
+	e.Tiers, _ = c.presence(req.Context(), key, time.Now())
+
+	return e, nil
+}
+
+// KeyDebug tells if a request asks for the explanation of its key, by
+// sending the secret. The secret is then removed from the request, so it
+// isn't sent to the upstreams
+func (c *cache) KeyDebug(req *http.Request) bool {
+	if c.keyDebugSecret == "" {
+		return false
+	}
+
+	v := req.Header.Get(c.keyDebugHeader)
+	if subtle.ConstantTimeCompare([]byte(v), []byte(c.keyDebugSecret)) != 1 {
+		return false
+	}
+	req.Header.Del(c.keyDebugHeader)
+
+	return true
+}
@@ -0,0 +1,67 @@
+// Package services has header handling helpers
+package services
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/mfamador/pistache/internal/requestid"
+)
+
+// hopByHopHeaders are meaningful only for a single transport-level connection
+// and must not be stored or forwarded. See RFC 7230, section 6.1
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// perResponseHeaders are computed for every response we send, so a stored
+// value would always be stale
+var perResponseHeaders = []string{
+	"Age",
+	"Cache-Status",
+	"Date",
+	"X-Pistache",
+	// The explanation of the key is only for the request asking for it
+	"X-Pistache-Key",
+	requestid.Header,
+}
+
+// perRequestHeaders identify a single request, so they never make up a key
+var perRequestHeaders = []string{
+	requestid.Header,
+	"Traceparent",
+	"Tracestate",
+}
+
+// RemoveHopByHopHeaders deletes the hop-by-hop headers, including the ones
+// listed in the Connection header
+func RemoveHopByHopHeaders(header http.Header) {
+	for _, v := range header.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+}
+
+func canonicalHeaderKeys(keys []string) []string {
+	canonical := make([]string, len(keys))
+	for i, v := range keys {
+		canonical[i] = http.CanonicalHeaderKey(v)
+	}
+
+	return canonical
+}
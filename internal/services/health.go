@@ -0,0 +1,170 @@
+// Package services has the upstream health checks
+package services
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultHealthCheckPath               = "/healthz"
+	defaultHealthCheckInterval           = 10
+	defaultHealthCheckTimeout            = 2
+	defaultHealthCheckHealthyThreshold   = 2
+	defaultHealthCheckUnhealthyThreshold = 3
+)
+
+var upstreamHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "pistache_upstream_healthy",
+	Help: "Whether an upstream target is healthy (1) or not (0)",
+}, []string{"pool", "upstream"})
+
+// HealthCheckConfig contains the active health check options for upstreams
+type HealthCheckConfig struct {
+	// Path to probe on every upstream target
+	Path string `yaml:"path"`
+	// Interval between probes, in seconds
+	Interval int `yaml:"interval"`
+	// Timeout of a probe, in seconds
+	Timeout int `yaml:"timeout"`
+	// ExpectedStatus of a healthy target. If not set, any 2XX is healthy
+	ExpectedStatus int `yaml:"expectedStatus"`
+	// HealthyThreshold is the number of consecutive successful probes to
+	// put a target back in rotation
+	HealthyThreshold int `yaml:"healthyThreshold"`
+	// UnhealthyThreshold is the number of consecutive failed probes to take
+	// a target out of rotation
+	UnhealthyThreshold int `yaml:"unhealthyThreshold"`
+}
+
+// healthChecker periodically probes the targets of a balancer
+type healthChecker struct {
+	conf     HealthCheckConfig
+	balancer *balancer
+	client   *http.Client
+	stop     chan struct{}
+	// rounds counts the probes of every target, up to the unhealthy
+	// threshold
+	rounds int32
+}
+
+func newHealthChecker(conf HealthCheckConfig, b *balancer, transport http.RoundTripper) *healthChecker {
+	if conf.Path == "" {
+		conf.Path = defaultHealthCheckPath
+	}
+	if conf.Interval <= 0 {
+		conf.Interval = defaultHealthCheckInterval
+	}
+	if conf.Timeout <= 0 {
+		conf.Timeout = defaultHealthCheckTimeout
+	}
+	if conf.HealthyThreshold <= 0 {
+		conf.HealthyThreshold = defaultHealthCheckHealthyThreshold
+	}
+	if conf.UnhealthyThreshold <= 0 {
+		conf.UnhealthyThreshold = defaultHealthCheckUnhealthyThreshold
+	}
+
+	return &healthChecker{
+		conf:     conf,
+		balancer: b,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   time.Duration(conf.Timeout) * time.Second,
+		},
+		stop: make(chan struct{}),
+	}
+}
+
+// Start probes the targets until the checker is stopped
+func (hc *healthChecker) Start() {
+	ticker := time.NewTicker(time.Duration(hc.conf.Interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		hc.checkAll()
+		if rounds := atomic.LoadInt32(&hc.rounds); int(rounds) < hc.conf.UnhealthyThreshold {
+			atomic.StoreInt32(&hc.rounds, rounds+1)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-hc.stop:
+			return
+		}
+	}
+}
+
+// Stop stops probing the targets
+func (hc *healthChecker) Stop() {
+	close(hc.stop)
+}
+
+// warmedUp tells if the targets were probed enough times to take the failing
+// ones out of rotation. Targets start healthy
+func (hc *healthChecker) warmedUp() bool {
+	return int(atomic.LoadInt32(&hc.rounds)) >= hc.conf.UnhealthyThreshold
+}
+
+func (hc *healthChecker) checkAll() {
+	var wg sync.WaitGroup
+	for _, t := range hc.balancer.all() {
+		wg.Add(1)
+		go func(t *upstreamTarget) {
+			defer wg.Done()
+			hc.record(t, hc.probe(t))
+		}(t)
+	}
+	wg.Wait()
+}
+
+func (hc *healthChecker) probe(t *upstreamTarget) bool {
+	u := *t.URL
+	u.Path = hc.conf.Path
+
+	resp, err := hc.client.Get(u.String())
+	if err != nil {
+		log.Debug().Err(err).Str("upstream", t.Name).Msg("Health check failed")
+		return false
+	}
+	defer resp.Body.Close()
+
+	if hc.conf.ExpectedStatus != 0 {
+		return resp.StatusCode == hc.conf.ExpectedStatus
+	}
+
+	return resp.StatusCode >= http.StatusOK && resp.StatusCode < http.StatusMultipleChoices
+}
+
+// record updates the health of a target once a threshold is reached
+func (hc *healthChecker) record(t *upstreamTarget, ok bool) {
+	if ok {
+		t.probeFailures = 0
+		t.probeSuccesses++
+		if t.probeSuccesses >= hc.conf.HealthyThreshold && t.setHealthy(true) {
+			log.Info().Str("pool", hc.balancer.name).Str("upstream", t.Name).Msg("Upstream is healthy")
+		}
+	} else {
+		t.probeSuccesses = 0
+		t.probeFailures++
+		if t.probeFailures >= hc.conf.UnhealthyThreshold && t.setHealthy(false) {
+			log.Warn().Str("pool", hc.balancer.name).Str("upstream", t.Name).Msg("Upstream is unhealthy")
+		}
+	}
+
+	upstreamHealthy.WithLabelValues(hc.balancer.name, t.Name).Set(boolToFloat(t.isHealthy()))
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+
+	return 0
+}
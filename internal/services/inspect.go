@@ -0,0 +1,226 @@
+// Package services has the inspection of the cache
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mfamador/pistache/internal/models"
+	"github.com/mfamador/pistache/internal/repos"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	defaultKeysPage = 100
+	maxKeysPage     = 1000
+)
+
+// tagHeaders list the tags of a response, used to purge related entries
+var tagHeaders = []string{"Cache-Tag", "Surrogate-Key"}
+
+// ErrUnknownTier is returned when inspecting a tier that isn't configured
+var ErrUnknownTier = errors.New("unknown cache tier")
+
+// TierPresence tells if a key is in a cache tier
+type TierPresence struct {
+	Tier    string `json:"tier"`
+	Present bool   `json:"present"`
+	// TTL is the number of seconds the entry is still served for
+	TTL int64 `json:"ttl,omitempty"`
+	// Error is the error looking the key up, if the tier failed
+	Error string `json:"error,omitempty"`
+}
+
+// KeyPage is a page of the keys of a tier
+type KeyPage struct {
+	Keys []string `json:"keys"`
+	// Cursor of the next page, empty after the last one
+	Cursor string `json:"cursor,omitempty"`
+}
+
+// Entry describes a cached response
+type Entry struct {
+	Key        string              `json:"key"`
+	StatusCode int                 `json:"statusCode"`
+	Header     map[string][]string `json:"header"`
+	// Size of the body, in bytes
+	Size      int       `json:"size"`
+	StoredAt  time.Time `json:"storedAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	// TTL is the number of seconds the entry is still served for
+	TTL int64 `json:"ttl"`
+	// Tags are the values of the Cache-Tag and Surrogate-Key headers
+	Tags []string `json:"tags,omitempty"`
+	// RequestID is the ID of the request the response was fetched for
+	RequestID string         `json:"requestId,omitempty"`
+	Tiers     []TierPresence `json:"tiers"`
+	// Body is sent on its own
+	Body []byte `json:"-"`
+}
+
+// Stats describes the content and the use of the cache tiers
+type Stats struct {
+	Tiers []TierStats `json:"tiers"`
+}
+
+// TierStats describes the content and the use of a cache tier
+type TierStats struct {
+	Tier string `json:"tier"`
+	repos.CacheStats
+	// Lookups are counted by result: hit, miss or stale
+	Lookups map[string]float64 `json:"lookups"`
+	// Stores are counted by result: success or failure
+	Stores map[string]float64 `json:"stores"`
+	// Error is the error reading the size of the tier, if it failed
+	Error string `json:"error,omitempty"`
+}
+
+type tier struct {
+	name string
+	repo repos.Cache
+}
+
+// tiers returns the configured tiers, in lookup order
+func (c *cache) tiers() []tier {
+	tiers := []tier{{TierMemory, c.inMemory}}
+	if c.redis != nil {
+		tiers = append(tiers, tier{TierRedis, c.redis})
+	}
+
+	return tiers
+}
+
+func (c *cache) tier(name string) (repos.Cache, error) {
+	for _, t := range c.tiers() {
+		if t.name == name {
+			return t.repo, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrUnknownTier, name)
+}
+
+// presence tells which tiers have a key, returning the first live entry.
+// The lookups aren't counted in the metrics
+func (c *cache) presence(ctx context.Context, key string, now time.Time) ([]TierPresence, *models.Response) {
+	var found *models.Response
+	tiers := c.tiers()
+	presence := make([]TierPresence, 0, len(tiers))
+	for _, t := range tiers {
+		p := TierPresence{Tier: t.name}
+		resp, err := t.repo.Fetch(ctx, key)
+		if err != nil {
+			p.Error = err.Error()
+		} else if resp != nil && (resp.ExpiresAt.IsZero() || now.Before(resp.ExpiresAt)) {
+			p.Present = true
+			if !resp.ExpiresAt.IsZero() {
+				p.TTL = int64(resp.TTL(now) / time.Second)
+			}
+			if found == nil {
+				found = resp
+			}
+		}
+		presence = append(presence, p)
+	}
+
+	return presence, found
+}
+
+// Keys lists the keys of a tier starting with a prefix, a page at a time
+func (c *cache) Keys(tierName, prefix, cursor string, count int) (*KeyPage, error) {
+	repo, err := c.tier(tierName)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case count <= 0:
+		count = defaultKeysPage
+	case count > maxKeysPage:
+		count = maxKeysPage
+	}
+
+	keys, next, err := repo.Keys(prefix, cursor, count)
+	if err != nil {
+		return nil, err
+	}
+	if keys == nil {
+		keys = []string{}
+	}
+
+	return &KeyPage{Keys: keys, Cursor: next}, nil
+}
+
+// Entry describes the cached response of a key, or returns nil if no tier
+// has it
+func (c *cache) Entry(key string) (*Entry, error) {
+	now := time.Now()
+	presence, resp := c.presence(context.Background(), key, now)
+	if resp == nil {
+		for _, p := range presence {
+			if p.Error != "" {
+				return nil, errors.New(p.Error)
+			}
+		}
+		return nil, nil
+	}
+
+	e := &Entry{
+		Key:        key,
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Size:       len(resp.Body),
+		StoredAt:   resp.StoredAt,
+		ExpiresAt:  resp.ExpiresAt,
+		TTL:        int64(resp.TTL(now) / time.Second),
+		RequestID:  resp.RequestID,
+		Tiers:      presence,
+		Body:       resp.Body,
+	}
+	for _, name := range tagHeaders {
+		for _, v := range resp.Header[name] {
+			e.Tags = append(e.Tags, strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == ' ' })...)
+		}
+	}
+
+	return e, nil
+}
+
+// Stats returns the size of every tier and how they're used
+func (c *cache) Stats() *Stats {
+	stats := &Stats{}
+	for _, t := range c.tiers() {
+		ts := TierStats{
+			Tier:    t.name,
+			Lookups: make(map[string]float64),
+			Stores:  make(map[string]float64),
+		}
+
+		var err error
+		if ts.CacheStats, err = t.repo.Stats(); err != nil {
+			ts.Error = err.Error()
+		}
+		for _, result := range []string{lookupHit, lookupMiss, lookupStale} {
+			ts.Lookups[result] = counterValue(cacheLookups.WithLabelValues(t.name, result))
+		}
+		for _, result := range []string{storeSuccess, storeFailure} {
+			ts.Stores[result] = counterValue(cacheStores.WithLabelValues(t.name, result))
+		}
+
+		stats.Tiers = append(stats.Tiers, ts)
+	}
+
+	return stats
+}
+
+func counterValue(c interface{ Write(*dto.Metric) error }) float64 {
+	m := &dto.Metric{}
+	if err := c.Write(m); err != nil {
+		return 0
+	}
+
+	return m.GetCounter().GetValue()
+}
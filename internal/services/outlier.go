@@ -0,0 +1,224 @@
+// Package services has the upstream outlier detection
+package services
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultOutlierInterval            = 10
+	defaultOutlierConsecutiveFailures = 5
+	defaultOutlierMinRequests         = 10
+	defaultOutlierBaseEjectionTime    = 30
+	defaultOutlierMaxEjectionTime     = 300
+	defaultOutlierMaxEjectionPercent  = 50
+)
+
+var (
+	upstreamEjected = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pistache_upstream_ejected",
+		Help: "Whether an upstream target is ejected by outlier detection (1) or not (0)",
+	}, []string{"pool", "upstream"})
+	upstreamEjections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pistache_upstream_ejections_total",
+		Help: "Number of times an upstream target was ejected by outlier detection",
+	}, []string{"pool", "upstream"})
+)
+
+// OutlierDetectionConfig contains the passive outlier detection options.
+// A failure is a connection error, a 5XX response or a response slower
+// than MaxLatency
+type OutlierDetectionConfig struct {
+	// Interval between evaluations of the failure rate, in seconds
+	Interval int `yaml:"interval"`
+	// ConsecutiveFailures ejects a target right away
+	ConsecutiveFailures int `yaml:"consecutiveFailures"`
+	// FailureRate, in percentage, ejects a target when evaluated.
+	// If not set, only consecutive failures eject targets
+	FailureRate int `yaml:"failureRate"`
+	// MinRequests in an interval to evaluate the failure rate of a target
+	MinRequests int `yaml:"minRequests"`
+	// MaxLatency of a response, in milliseconds. If not set, latency is ignored
+	MaxLatency int `yaml:"maxLatency"`
+	// BaseEjectionTime, in seconds, doubles with every consecutive ejection
+	BaseEjectionTime int `yaml:"baseEjectionTime"`
+	// MaxEjectionTime, in seconds
+	MaxEjectionTime int `yaml:"maxEjectionTime"`
+	// MaxEjectionPercent of the targets that can be ejected at the same time
+	MaxEjectionPercent int `yaml:"maxEjectionPercent"`
+}
+
+// outlierState is the outlier detection state of an upstream target
+type outlierState struct {
+	mutex               sync.Mutex
+	ejectedUntil        time.Time
+	ejections           int
+	consecutiveFailures int
+	requests            int
+	failures            int
+}
+
+func (s *outlierState) ejected(now time.Time) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return now.Before(s.ejectedUntil)
+}
+
+// outlierDetector ejects the targets of a balancer misbehaving on real traffic
+type outlierDetector struct {
+	conf     OutlierDetectionConfig
+	balancer *balancer
+	stop     chan struct{}
+}
+
+func newOutlierDetector(conf OutlierDetectionConfig, b *balancer) *outlierDetector {
+	if conf.Interval <= 0 {
+		conf.Interval = defaultOutlierInterval
+	}
+	if conf.ConsecutiveFailures <= 0 {
+		conf.ConsecutiveFailures = defaultOutlierConsecutiveFailures
+	}
+	if conf.MinRequests <= 0 {
+		conf.MinRequests = defaultOutlierMinRequests
+	}
+	if conf.BaseEjectionTime <= 0 {
+		conf.BaseEjectionTime = defaultOutlierBaseEjectionTime
+	}
+	if conf.MaxEjectionTime <= 0 {
+		conf.MaxEjectionTime = defaultOutlierMaxEjectionTime
+	}
+	if conf.MaxEjectionPercent <= 0 {
+		conf.MaxEjectionPercent = defaultOutlierMaxEjectionPercent
+	}
+
+	return &outlierDetector{
+		conf:     conf,
+		balancer: b,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start evaluates the targets every interval until the detector is stopped
+func (od *outlierDetector) Start() {
+	ticker := time.NewTicker(time.Duration(od.conf.Interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			od.evaluate(time.Now())
+		case <-od.stop:
+			return
+		}
+	}
+}
+
+// Stop stops evaluating the targets
+func (od *outlierDetector) Stop() {
+	close(od.stop)
+}
+
+// record accounts the outcome of a request proxied to a target
+func (od *outlierDetector) record(t *upstreamTarget, failed bool, latency time.Duration) {
+	if od.conf.MaxLatency > 0 && latency > time.Duration(od.conf.MaxLatency)*time.Millisecond {
+		failed = true
+	}
+
+	s := &t.outlier
+	s.mutex.Lock()
+	s.requests++
+	if failed {
+		s.failures++
+		s.consecutiveFailures++
+	} else {
+		s.consecutiveFailures = 0
+	}
+	eject := s.consecutiveFailures >= od.conf.ConsecutiveFailures
+	s.mutex.Unlock()
+
+	if eject {
+		od.eject(t, time.Now(), "consecutive failures")
+	}
+}
+
+// evaluate ejects the targets over the failure rate and resets the counters
+func (od *outlierDetector) evaluate(now time.Time) {
+	for _, t := range od.balancer.all() {
+		s := &t.outlier
+		s.mutex.Lock()
+		overRate := od.conf.FailureRate > 0 && s.requests >= od.conf.MinRequests &&
+			s.failures*100 >= od.conf.FailureRate*s.requests
+		wasEjected := !s.ejectedUntil.IsZero()
+		returned := wasEjected && !now.Before(s.ejectedUntil)
+		if returned {
+			s.ejectedUntil = time.Time{}
+		} else if !wasEjected && s.failures == 0 && s.ejections > 0 {
+			// A clean interval makes the next ejection shorter
+			s.ejections--
+		}
+		s.requests = 0
+		s.failures = 0
+		s.mutex.Unlock()
+
+		if returned {
+			log.Info().Str("pool", od.balancer.name).Str("upstream", t.Name).Msg("Upstream is back from ejection")
+			upstreamEjected.WithLabelValues(od.balancer.name, t.Name).Set(0)
+		}
+
+		if overRate {
+			od.eject(t, now, "failure rate")
+		}
+	}
+}
+
+// eject takes a target out of rotation, unless too many already are
+func (od *outlierDetector) eject(t *upstreamTarget, now time.Time, reason string) {
+	targets := od.balancer.all()
+	ejected := 0
+	for _, v := range targets {
+		if v.outlier.ejected(now) {
+			ejected++
+		}
+	}
+
+	s := &t.outlier
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if now.Before(s.ejectedUntil) {
+		return
+	}
+
+	if (ejected+1)*100 > od.conf.MaxEjectionPercent*len(targets) {
+		log.Warn().Str("pool", od.balancer.name).Str("upstream", t.Name).Str("reason", reason).
+			Msg("Not ejecting upstream, too many are ejected already")
+		return
+	}
+
+	s.ejections++
+	ejection := time.Duration(od.conf.BaseEjectionTime) * time.Second
+	for i := 1; i < s.ejections && ejection < time.Duration(od.conf.MaxEjectionTime)*time.Second; i++ {
+		ejection *= 2
+	}
+	if maxEjection := time.Duration(od.conf.MaxEjectionTime) * time.Second; ejection > maxEjection {
+		ejection = maxEjection
+	}
+
+	s.ejectedUntil = now.Add(ejection)
+	s.consecutiveFailures = 0
+
+	log.Warn().
+		Str("pool", od.balancer.name).
+		Str("upstream", t.Name).
+		Str("reason", reason).
+		Dur("ejection", ejection).
+		Msg("Ejecting upstream")
+	upstreamEjected.WithLabelValues(od.balancer.name, t.Name).Set(1)
+	upstreamEjections.WithLabelValues(od.balancer.name, t.Name).Inc()
+}
@@ -0,0 +1,109 @@
+// Package services has the upstream pools
+package services
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// DefaultPool is the name of the pool defined at the top level of the proxy
+// config
+const DefaultPool = "default"
+
+// PoolConfig contains the config options of a pool of upstream targets
+type PoolConfig struct {
+	Upstreams        []Upstream              `yaml:"upstreams"`
+	HealthCheck      *HealthCheckConfig      `yaml:"healthCheck"`
+	OutlierDetection *OutlierDetectionConfig `yaml:"outlierDetection"`
+	Balancing        string                  `yaml:"balancing" default:"roundRobin"`
+	TLS              *UpstreamTLSConfig      `yaml:"tls"`
+	Retry            *RetryConfig            `yaml:"retry"`
+	Timeouts         TimeoutConfig           `yaml:"timeouts"`
+	ConnectionPool   ConnectionPoolConfig    `yaml:"connectionPool"`
+	Discovery        *DiscoveryConfig        `yaml:"discovery"`
+}
+
+// pool is a set of upstream targets balanced together
+type pool struct {
+	name            string
+	balancer        *balancer
+	transport       *http.Transport
+	healthChecker   *healthChecker
+	outlierDetector *outlierDetector
+	retry           *retryPolicy
+	discovery       *discovery
+	requestTimeout  time.Duration
+}
+
+func newPool(name string, conf PoolConfig) (*pool, error) {
+	targets := make([]*upstreamTarget, len(conf.Upstreams))
+	for i, upstream := range conf.Upstreams {
+		u, err := upstream.URL()
+		if err != nil {
+			return nil, err
+		}
+
+		targets[i] = newUpstreamTarget(&middleware.ProxyTarget{Name: upstream.Name(), URL: u}, upstream.Weight)
+	}
+
+	s, err := newStrategy(conf.Balancing)
+	if err != nil {
+		return nil, err
+	}
+
+	transport, err := newTransport(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &pool{
+		name:      name,
+		balancer:  newBalancer(name, targets, s),
+		transport: transport,
+		// The other timeouts are enforced by the transport
+		requestTimeout: milliseconds(conf.Timeouts.Request),
+	}
+
+	if conf.Discovery != nil {
+		p.discovery, err = newDiscovery(*conf.Discovery, p.balancer)
+		if err != nil {
+			return nil, err
+		}
+		// Resolve the upstreams once before serving, so the pool isn't empty
+		p.discovery.refresh()
+		go p.discovery.Start()
+	}
+
+	if conf.HealthCheck != nil {
+		p.healthChecker = newHealthChecker(*conf.HealthCheck, p.balancer, transport)
+		go p.healthChecker.Start()
+	}
+
+	if conf.Retry != nil {
+		p.retry = newRetryPolicy(name, *conf.Retry)
+	}
+
+	if conf.OutlierDetection != nil {
+		p.outlierDetector = newOutlierDetector(*conf.OutlierDetection, p.balancer)
+		go p.outlierDetector.Start()
+	}
+
+	return p, nil
+}
+
+// stop stops discovering, probing and evaluating the targets, and closes the
+// idle upstream connections
+func (p *pool) stop() {
+	if p.discovery != nil {
+		p.discovery.Stop()
+	}
+	if p.healthChecker != nil {
+		p.healthChecker.Stop()
+	}
+	if p.outlierDetector != nil {
+		p.outlierDetector.Stop()
+	}
+	p.transport.CloseIdleConnections()
+}
@@ -2,80 +2,395 @@
 package services
 
 import (
+	"context"
 	"fmt"
+	"net"
+	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/mfamador/pistache/internal/models"
+	"github.com/mfamador/pistache/internal/requestid"
+	"go.opentelemetry.io/otel/api/trace"
+	"go.opentelemetry.io/otel/semconv"
 )
 
-// ProxyConfig contains the Proxy config options
+const (
+	// targetContextKey is where the proxy middleware stores the chosen target
+	targetContextKey = "target"
+	// proxyErrorContextKey is where the proxy middleware stores its errors
+	proxyErrorContextKey = "_error"
+	// defaultMaxCacheableSize is 10 MiB
+	defaultMaxCacheableSize = 10 << 20
+)
+
+// ProxyConfig contains the Proxy config options. The upstreams at the top
+// level make up the default pool, used by requests matching no route
 type ProxyConfig struct {
-	Upstreams []Upstream `yaml:"upstreams"`
+	PoolConfig `yaml:",inline"`
+	Pools      map[string]PoolConfig `yaml:"pools"`
+	Routes     []RouteConfig         `yaml:"routes"`
+	// MaxCacheableSize is the size, in bytes, of the largest response body
+	// kept for the cache. Larger responses are still sent to the client
+	MaxCacheableSize int64 `yaml:"maxCacheableSize"`
 }
 
 // Upstream defines an upstream target
 type Upstream struct {
-	Host string
-	Port int
+	Host   string
+	Port   int
+	Weight int `yaml:"weight"`
+	// Scheme is either http or https
+	Scheme string `yaml:"scheme" default:"http"`
 }
 
 // URL returns a url.URL object for this upstream
 func (u Upstream) URL() (*url.URL, error) {
-	return url.Parse(fmt.Sprintf("http://%s:%d", u.Host, u.Port))
+	scheme := u.Scheme
+	switch scheme {
+	case "":
+		scheme = "http"
+	case "http", "https":
+	default:
+		return nil, fmt.Errorf("invalid scheme %q for upstream %s", u.Scheme, u.Name())
+	}
+
+	return url.Parse(fmt.Sprintf("%s://%s", scheme, u.Name()))
+}
+
+// Name returns the name identifying this upstream
+func (u Upstream) Name() string {
+	return net.JoinHostPort(u.Host, strconv.Itoa(u.Port))
+}
+
+// UpstreamStatus describes the state of an upstream target
+type UpstreamStatus struct {
+	Pool    string `json:"pool"`
+	Name    string `json:"name"`
+	URL     string `json:"url"`
+	Healthy bool   `json:"healthy"`
+	Ejected bool   `json:"ejected"`
+	Weight  int    `json:"weight"`
+	// InFlight is the number of requests being proxied to the target
+	InFlight int64 `json:"inFlight"`
 }
 
 // Proxy defines a proxy service
 type Proxy interface {
 	Request(c echo.Context) (*models.Response, error)
+	Upstreams() []UpstreamStatus
+	Route(req *http.Request) string
+	WarmedUp() bool
+	// Stop stops the discovery, health checks and outlier detection of the
+	// pools
+	Stop()
 }
 
 type proxy struct {
-	proxyHandler echo.HandlerFunc
+	pools            map[string]*pool
+	routes           []*route
+	defaultRoute     *route
+	maxCacheableSize int64
 }
 
 // NewProxy creates a new Configs service
 func NewProxy(conf ProxyConfig) (Proxy, error) {
-	targets := make([]*middleware.ProxyTarget, len(conf.Upstreams))
-	for i, upstream := range conf.Upstreams {
-		u, err := upstream.URL()
-		if err != nil {
+	if _, ok := conf.Pools[DefaultPool]; ok {
+		return nil, fmt.Errorf("pool name %q is reserved", DefaultPool)
+	}
+
+	p := &proxy{
+		pools:            make(map[string]*pool, len(conf.Pools)+1),
+		maxCacheableSize: conf.MaxCacheableSize,
+	}
+	if p.maxCacheableSize <= 0 {
+		p.maxCacheableSize = defaultMaxCacheableSize
+	}
+
+	defaultPool, err := newPool(DefaultPool, conf.PoolConfig)
+	if err != nil {
+		return nil, err
+	}
+	p.pools[DefaultPool] = defaultPool
+
+	for name, poolConf := range conf.Pools {
+		if p.pools[name], err = newPool(name, poolConf); err != nil {
 			return nil, err
 		}
+	}
 
-		targets[i] = &middleware.ProxyTarget{URL: u}
+	for _, routeConf := range conf.Routes {
+		r, err := newRoute(routeConf, p.pools)
+		if err != nil {
+			return nil, err
+		}
+		p.routes = append(p.routes, r)
 	}
 
-	balancer := middleware.NewRoundRobinBalancer(targets)
+	p.defaultRoute = &route{
+		name:    DefaultPool,
+		pool:    defaultPool,
+		handler: proxyHandler(defaultPool, nil),
+	}
 
-	return &proxy{
-		proxyHandler: middleware.Proxy(balancer)(noop),
-	}, nil
+	return p, nil
 }
 
 // Request proxies an HTTP request
 func (h proxy) Request(c echo.Context) (*models.Response, error) {
-	// If we don't have the pistached value, something is wrong, so just forward
-	// the request
-	// If pistached is false, then we don't want to cache it, so just forward the
-	// request
-	if c.Get("pistached") == nil || !c.Get("pistached").(bool) {
-		return nil, h.proxyHandler(c)
+	r := h.route(c.Request())
+	if len(r.pool.balancer.all()) == 0 {
+		return nil, echo.NewHTTPError(http.StatusBadGateway, fmt.Sprintf("no upstream in pool %s", r.pool.name))
+	}
+
+	// The response is only kept for the cache when pistached is true. Without
+	// the value, the request is just forwarded
+	pistached, _ := c.Get("pistached").(bool)
+	hold, _ := c.Get(HoldContextKey).(bool)
+
+	res := c.Response()
+	capture := &responseCapture{
+		ResponseWriter: res.Writer,
+		logger:         requestid.Logger(c.Request().Context()),
+		keep:           pistached,
+		hold:           pistached && hold,
+		limit:          h.maxCacheableSize,
+	}
+	res.Writer = capture
+	defer func() { res.Writer = capture.ResponseWriter }()
+
+	if err := h.forwarder(r)(c); err != nil || !capture.keep || capture.streaming {
+		// Streams and large responses went through as they were, there's
+		// nothing to cache
+		return nil, err
 	}
 
 	rp := &models.Response{}
-	err := middleware.BodyDump(ResponseStorer(rp))(h.proxyHandler)(c)
+	ResponseStorer(rp)(c, nil, capture.body.Bytes())
+
+	if capture.held {
+		// Nothing was sent, the caller answers from the response
+		res.Committed = false
+		res.Size = 0
+	}
+
+	return rp, nil
+}
+
+// Route returns the name of the route a request is sent to
+func (h proxy) Route(req *http.Request) string {
+	return h.route(req).name
+}
+
+// route returns the first route matching a request
+func (h proxy) route(req *http.Request) *route {
+	for _, r := range h.routes {
+		if r.matches(req) {
+			return r
+		}
+	}
+
+	return h.defaultRoute
+}
+
+// forwarder returns the handler forwarding a request to a route, retrying
+// it if the pool allows it
+func (h proxy) forwarder(r *route) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if d := r.pool.requestTimeout; d > 0 {
+			req := c.Request()
+			ctx, cancel := context.WithTimeout(req.Context(), d)
+			defer cancel()
+			c.SetRequest(req.WithContext(ctx))
+			defer c.SetRequest(req)
+		}
+
+		if r.pool.retry == nil {
+			_, err := h.forward(c, r)
+			return err
+		}
+
+		req := c.Request()
+		s := newRetryState(r.pool.retry, c)
+		c.SetRequest(req.WithContext(context.WithValue(req.Context(), retryContextKey, s)))
+		defer c.SetRequest(req)
+
+		// The proxy rewrites the path in place, so every attempt starts over
+		path, rawPath := req.URL.Path, req.URL.RawPath
+		for {
+			req.URL.Path, req.URL.RawPath = path, rawPath
+			tgt, err := h.forward(c, r)
+			if tgt != nil {
+				s.tried = append(s.tried, tgt.Name)
+			}
+
+			if err == nil && !s.scheduled {
+				return nil
+			}
 
-	return rp, err
+			// Connection errors can be retried, as long as nothing was sent back
+			if err != nil && (c.Response().Committed || !s.schedule()) {
+				return err
+			}
+
+			s.scheduled = false
+			s.retries++
+
+			select {
+			case <-time.After(r.pool.retry.backoff(s.retries)):
+			case <-req.Context().Done():
+				return err
+			}
+		}
+	}
+}
+
+// forward runs the proxy handler of a route once, recording the outcome for
+// the chosen target
+func (h proxy) forward(c echo.Context, r *route) (*middleware.ProxyTarget, error) {
+	c.Set(proxyErrorContextKey, nil)
+	c.Set(targetContextKey, nil)
+
+	req := c.Request()
+	ctx, span := tracer.Start(req.Context(), "proxy", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(poolLabel.String(r.pool.name)))
+	defer span.End()
+
+	rt := &roundTrip{}
+	c.SetRequest(req.WithContext(context.WithValue(ctx, roundTripContextKey, rt)))
+	defer c.SetRequest(req)
+
+	if accept := req.Header.Get(echo.HeaderAccept); accept == mimeEventStream {
+		// The proxy middleware drops requests accepting only event streams,
+		// so the header is hidden from it and the transport sends it along
+		rt.accept = accept
+		req.Header.Del(echo.HeaderAccept)
+		defer req.Header.Set(echo.HeaderAccept, accept)
+	}
+	if c.IsWebSocket() {
+		// The proxy middleware dials WebSocket upstreams itself, bypassing
+		// the pool transport, so the upgrade is hidden from it. The reverse
+		// proxy then switches protocols over the transport
+		rt.upgrade = req.Header.Get(echo.HeaderUpgrade)
+		req.Header.Del(echo.HeaderUpgrade)
+		defer req.Header.Set(echo.HeaderUpgrade, rt.upgrade)
+	}
+
+	start := time.Now()
+	defer func() {
+		// The reverse proxy panics with http.ErrAbortHandler when copying the
+		// body fails after the response was sent. The target is still
+		// released, and the failure counted
+		if p := recover(); p != nil {
+			if err, ok := p.(error); ok {
+				recordError(ctx, span, err)
+			}
+			h.release(c, r, start, true)
+			panic(p)
+		}
+	}()
+
+	err := r.handler(c)
+	if err != nil && rt.timedOut {
+		err = fmt.Errorf("%w: %v", ErrUpstreamTimeout, err)
+	}
+
+	if err != nil {
+		recordError(ctx, span, err)
+	} else if res := c.Response(); res.Committed {
+		span.SetAttributes(semconv.HTTPAttributesFromHTTPStatusCode(res.Status)...)
+		span.SetStatus(semconv.SpanStatusFromHTTPStatusCode(res.Status))
+	}
+
+	tgt := h.release(c, r, start, err != nil)
+	if tgt == nil {
+		return nil, err
+	}
+	span.SetAttributes(upstreamLabel.String(tgt.Name))
+
+	return tgt, err
+}
+
+// release ends the request to the target chosen by the balancer, if any, and
+// records its outcome for the outlier detection
+func (h proxy) release(c echo.Context, r *route, start time.Time, failed bool) *middleware.ProxyTarget {
+	tgt, ok := c.Get(targetContextKey).(*middleware.ProxyTarget)
+	if !ok || tgt == nil {
+		return nil
+	}
+
+	b := r.pool.balancer
+	b.done(tgt.Name)
+
+	if od := r.pool.outlierDetector; od != nil {
+		if t := b.target(tgt.Name); t != nil {
+			failed = failed || c.Response().Status >= http.StatusInternalServerError
+			od.record(t, failed, time.Since(start))
+		}
+	}
+
+	return tgt
+}
+
+// Upstreams returns the state of every upstream target
+func (h proxy) Upstreams() []UpstreamStatus {
+	names := make([]string, 0, len(h.pools))
+	for name := range h.pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	now := time.Now()
+	statuses := []UpstreamStatus{}
+	for _, name := range names {
+		for _, t := range h.pools[name].balancer.all() {
+			statuses = append(statuses, UpstreamStatus{
+				Pool:     name,
+				Name:     t.Name,
+				URL:      t.URL.String(),
+				Healthy:  t.isHealthy(),
+				Ejected:  t.outlier.ejected(now),
+				Weight:   t.weight,
+				InFlight: t.inFlight(),
+			})
+		}
+	}
+
+	return statuses
+}
+
+// WarmedUp tells if every pool probed its upstream targets enough times for
+// their health to be known
+func (h proxy) WarmedUp() bool {
+	for _, p := range h.pools {
+		if p.healthChecker != nil && !p.healthChecker.warmedUp() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Stop stops the background work of every pool
+func (h proxy) Stop() {
+	for _, p := range h.pools {
+		p.stop()
+	}
 }
 
 // ResponseStorer stores response information in a `models.Response`
 func ResponseStorer(rp *models.Response) func(echo.Context, []byte, []byte) {
 	return func(c echo.Context, reqBody, resBody []byte) {
 		rp.StatusCode = c.Response().Status
-		rp.Header = c.Response().Writer.Header()
+		header := c.Response().Writer.Header().Clone()
+		RemoveHopByHopHeaders(header)
+		rp.Header = header
 		rp.Body = resBody
+		rp.RequestID = requestid.FromContext(c.Request().Context())
 	}
 }
 
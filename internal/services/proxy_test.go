@@ -0,0 +1,937 @@
+package services_test
+
+import (
+	"bufio"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mfamador/pistache/internal/models"
+	"github.com/mfamador/pistache/internal/requestid"
+	"github.com/mfamador/pistache/internal/services"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"go.opentelemetry.io/otel/api/trace"
+	"go.opentelemetry.io/otel/label"
+	exporttrace "go.opentelemetry.io/otel/sdk/export/trace"
+)
+
+var _ = Describe("Proxy service", func() {
+	Context("ResponseStorer", func() {
+		It("should store a copy of the headers without hop-by-hop headers", func() {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/dummy", nil)
+			c := echo.New().NewContext(r, w)
+
+			header := c.Response().Header()
+			header.Add("Vary", "Accept")
+			header.Add("Vary", "Accept-Encoding")
+			header.Set("Connection", "X-Hop")
+			header.Set("X-Hop", "1")
+			header.Set("Keep-Alive", "timeout=5")
+			c.Response().WriteHeader(http.StatusOK)
+
+			rp := &models.Response{}
+			services.ResponseStorer(rp)(c, nil, []byte("body"))
+
+			Expect(rp.StatusCode).To(Equal(http.StatusOK))
+			Expect(rp.Body).To(Equal([]byte("body")))
+			Expect(rp.Header["Vary"]).To(Equal([]string{"Accept", "Accept-Encoding"}))
+			Expect(rp.Header).ToNot(HaveKey("Connection"))
+			Expect(rp.Header).ToNot(HaveKey("X-Hop"))
+			Expect(rp.Header).ToNot(HaveKey("Keep-Alive"))
+
+			header.Set("X-Later", "1")
+			Expect(rp.Header).ToNot(HaveKey("X-Later"))
+		})
+
+		It("should store the ID of the request", func() {
+			r := httptest.NewRequest(http.MethodGet, "/dummy", nil)
+			r = r.WithContext(requestid.NewContext(r.Context(), "origin"))
+			c := echo.New().NewContext(r, httptest.NewRecorder())
+
+			rp := &models.Response{}
+			services.ResponseStorer(rp)(c, nil, nil)
+
+			Expect(rp.RequestID).To(Equal("origin"))
+		})
+	})
+})
+
+// upstreamFor returns the upstream config pointing to a test server
+func upstreamFor(server *httptest.Server) services.Upstream {
+	u, err := url.Parse(server.URL)
+	Expect(err).ToNot(HaveOccurred())
+	port, err := strconv.Atoi(u.Port())
+	Expect(err).ToNot(HaveOccurred())
+
+	return services.Upstream{Host: u.Hostname(), Port: port}
+}
+
+// proxyRequest sends a request through the proxy service, returning the body
+func proxyRequest(p services.Proxy) string {
+	return proxyRequestWithKey(p, "")
+}
+
+// proxyRequestWithKey sends a request with a cache key through the proxy
+// service, returning the body
+func proxyRequestWithKey(p services.Proxy, key string) string {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/dummy", nil)
+	c := echo.New().NewContext(r, w)
+	if key != "" {
+		c.Set(services.CacheKeyContextKey, key)
+	}
+
+	_, err := p.Request(c)
+	Expect(err).ToNot(HaveOccurred())
+
+	return w.Body.String()
+}
+
+// testUpstream is a test server whose health can be switched on and off
+type testUpstream struct {
+	*httptest.Server
+	healthy int32
+}
+
+func newTestUpstream(name string) *testUpstream {
+	u := &testUpstream{healthy: 1}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" {
+			if atomic.LoadInt32(&u.healthy) == 0 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			return
+		}
+		_, _ = w.Write([]byte(name))
+	}))
+
+	return u
+}
+
+func (u *testUpstream) setHealthy(healthy bool) {
+	var v int32
+	if healthy {
+		v = 1
+	}
+	atomic.StoreInt32(&u.healthy, v)
+}
+
+var _ = Describe("Proxy health checks", func() {
+	var (
+		a, b *testUpstream
+		p    services.Proxy
+	)
+
+	upstreamHealth := func(name string) func() bool {
+		return func() bool {
+			for _, s := range p.Upstreams() {
+				if s.Name == name {
+					return s.Healthy
+				}
+			}
+			return false
+		}
+	}
+
+	BeforeEach(func() {
+		a = newTestUpstream("a")
+		b = newTestUpstream("b")
+
+		var err error
+		p, err = services.NewProxy(services.ProxyConfig{PoolConfig: services.PoolConfig{
+			Upstreams: []services.Upstream{upstreamFor(a.Server), upstreamFor(b.Server)},
+			HealthCheck: &services.HealthCheckConfig{
+				Interval:           1,
+				HealthyThreshold:   1,
+				UnhealthyThreshold: 1,
+			},
+		}})
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		a.Close()
+		b.Close()
+	})
+
+	It("should take an unhealthy upstream out of rotation and back", func() {
+		aName := upstreamFor(a.Server).Name()
+		Expect(p.Upstreams()).To(HaveLen(2))
+
+		a.setHealthy(false)
+		Eventually(upstreamHealth(aName), 3*time.Second).Should(BeFalse())
+		for i := 0; i < 4; i++ {
+			Expect(proxyRequest(p)).To(Equal("b"))
+		}
+
+		a.setHealthy(true)
+		Eventually(upstreamHealth(aName), 3*time.Second).Should(BeTrue())
+		Expect([]string{proxyRequest(p), proxyRequest(p)}).To(ConsistOf("a", "b"))
+	})
+	It("should stop probing once stopped", func() {
+		aName := upstreamFor(a.Server).Name()
+		// Let the first round finish
+		Eventually(p.WarmedUp).Should(BeTrue())
+		p.Stop()
+
+		a.setHealthy(false)
+		Consistently(upstreamHealth(aName), 2*time.Second).Should(BeTrue())
+	})
+})
+
+var _ = Describe("Proxy outlier detection", func() {
+	var (
+		good, bad *httptest.Server
+		p         services.Proxy
+	)
+
+	BeforeEach(func() {
+		good = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("good"))
+		}))
+		bad = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte("bad"))
+		}))
+
+		var err error
+		p, err = services.NewProxy(services.ProxyConfig{PoolConfig: services.PoolConfig{
+			Upstreams: []services.Upstream{upstreamFor(good), upstreamFor(bad)},
+			OutlierDetection: &services.OutlierDetectionConfig{
+				ConsecutiveFailures: 2,
+				BaseEjectionTime:    60,
+			},
+		}})
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		good.Close()
+		bad.Close()
+	})
+
+	It("should eject an upstream failing consecutively", func() {
+		for i := 0; i < 4; i++ {
+			proxyRequest(p)
+		}
+
+		badName := upstreamFor(bad).Name()
+		for _, s := range p.Upstreams() {
+			Expect(s.Ejected).To(Equal(s.Name == badName))
+		}
+
+		for i := 0; i < 4; i++ {
+			Expect(proxyRequest(p)).To(Equal("good"))
+		}
+	})
+
+	It("should release and count an upstream cutting the body short", func() {
+		cut := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(echo.HeaderContentLength, "100")
+			_, _ = w.Write([]byte("short"))
+		}))
+		defer cut.Close()
+
+		p, err := services.NewProxy(services.ProxyConfig{PoolConfig: services.PoolConfig{
+			Upstreams: []services.Upstream{upstreamFor(cut)},
+			OutlierDetection: &services.OutlierDetectionConfig{
+				ConsecutiveFailures: 3,
+				BaseEjectionTime:    60,
+				MaxEjectionPercent:  100,
+			},
+		}})
+		Expect(err).ToNot(HaveOccurred())
+
+		// The reverse proxy only aborts the handler of a real server
+		front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = p.Request(echo.New().NewContext(r, w))
+		}))
+		defer front.Close()
+
+		for i := 0; i < 3; i++ {
+			resp, err := http.Get(front.URL + "/dummy")
+			if err == nil {
+				_, _ = ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+			}
+		}
+
+		Eventually(func() bool { return p.Upstreams()[0].Ejected }).Should(BeTrue())
+		Expect(p.Upstreams()[0].InFlight).To(BeZero())
+	})
+})
+
+var _ = Describe("Proxy retries", func() {
+	var (
+		good, unavailable, down *httptest.Server
+		hits                    int32
+	)
+
+	BeforeEach(func() {
+		atomic.StoreInt32(&hits, 0)
+		good = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("good"))
+		}))
+		unavailable = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&hits, 1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		// A closed server refuses connections
+		down = httptest.NewServer(http.NotFoundHandler())
+		down.Close()
+	})
+
+	AfterEach(func() {
+		good.Close()
+		unavailable.Close()
+	})
+
+	newProxy := func(retry services.RetryConfig, upstreams ...*httptest.Server) services.Proxy {
+		conf := services.PoolConfig{Retry: &retry}
+		for _, u := range upstreams {
+			conf.Upstreams = append(conf.Upstreams, upstreamFor(u))
+		}
+		p, err := services.NewProxy(services.ProxyConfig{PoolConfig: conf})
+		Expect(err).ToNot(HaveOccurred())
+		return p
+	}
+
+	send := func(p services.Proxy, method string) (*httptest.ResponseRecorder, error) {
+		var body io.Reader
+		if method == http.MethodPost {
+			body = strings.NewReader("body")
+		}
+		w := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(method, "/dummy", body), w)
+		_, err := p.Request(c)
+		return w, err
+	}
+
+	It("should retry a connection error on another upstream", func() {
+		p := newProxy(services.RetryConfig{BaseBackoff: 1, MaxBackoff: 1}, down, good)
+
+		for i := 0; i < 4; i++ {
+			w, err := send(p, http.MethodGet)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(w.Body.String()).To(Equal("good"))
+		}
+	})
+
+	It("should retry the configured status codes", func() {
+		p := newProxy(services.RetryConfig{
+			OnStatus:    []int{http.StatusServiceUnavailable},
+			BaseBackoff: 1,
+			MaxBackoff:  1,
+		}, unavailable, good)
+
+		for i := 0; i < 4; i++ {
+			w, err := send(p, http.MethodGet)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(w.Body.String()).To(Equal("good"))
+		}
+		Expect(atomic.LoadInt32(&hits)).To(BeNumerically(">", 0))
+	})
+
+	It("should return the last response once out of attempts", func() {
+		p := newProxy(services.RetryConfig{
+			Attempts:    2,
+			OnStatus:    []int{http.StatusServiceUnavailable},
+			BaseBackoff: 1,
+			MaxBackoff:  1,
+		}, unavailable)
+
+		w, err := send(p, http.MethodGet)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(w.Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(atomic.LoadInt32(&hits)).To(Equal(int32(3)))
+	})
+
+	It("should not retry a non idempotent request", func() {
+		p := newProxy(services.RetryConfig{BaseBackoff: 1, MaxBackoff: 1}, down, good)
+
+		failures := 0
+		for i := 0; i < 4; i++ {
+			if _, err := send(p, http.MethodPost); err != nil {
+				failures++
+			}
+		}
+		Expect(failures).To(Equal(2))
+	})
+
+	It("should stop retrying once the budget is spent", func() {
+		p := newProxy(services.RetryConfig{Budget: 1, BaseBackoff: 1, MaxBackoff: 1}, down, good)
+
+		failures := 0
+		for i := 0; i < 40; i++ {
+			if _, err := send(p, http.MethodGet); err != nil {
+				failures++
+			}
+		}
+		Expect(failures).To(BeNumerically(">", 0))
+	})
+})
+
+var _ = Describe("Proxy timeouts", func() {
+	var slow *httptest.Server
+
+	BeforeEach(func() {
+		slow = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-time.After(time.Second):
+			case <-r.Context().Done():
+			}
+			_, _ = w.Write([]byte("slow"))
+		}))
+	})
+
+	AfterEach(func() {
+		slow.Close()
+	})
+
+	send := func(timeouts services.TimeoutConfig) error {
+		p, err := services.NewProxy(services.ProxyConfig{PoolConfig: services.PoolConfig{
+			Upstreams: []services.Upstream{upstreamFor(slow)},
+			Timeouts:  timeouts,
+		}})
+		Expect(err).ToNot(HaveOccurred())
+
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/dummy", nil), httptest.NewRecorder())
+		_, err = p.Request(c)
+		return err
+	}
+
+	It("should time out waiting for the response headers", func() {
+		err := send(services.TimeoutConfig{ResponseHeader: 50})
+		Expect(errors.Is(err, services.ErrUpstreamTimeout)).To(BeTrue())
+	})
+
+	It("should time out the whole request", func() {
+		err := send(services.TimeoutConfig{ResponseHeader: -1, Request: 50})
+		Expect(errors.Is(err, services.ErrUpstreamTimeout)).To(BeTrue())
+	})
+
+	It("should wait for a slow upstream within the timeouts", func() {
+		Expect(send(services.TimeoutConfig{})).To(Succeed())
+	})
+})
+
+var _ = Describe("Proxy tracing", func() {
+	It("should trace the upstream request and propagate its context", func() {
+		traceparent := make(chan string, 1)
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			traceparent <- r.Header.Get("traceparent")
+		}))
+		defer upstream.Close()
+
+		p, err := services.NewProxy(services.ProxyConfig{PoolConfig: services.PoolConfig{
+			Upstreams: []services.Upstream{upstreamFor(upstream)},
+		}})
+		Expect(err).ToNot(HaveOccurred())
+
+		spans.Reset()
+		proxyRequest(p)
+
+		var span *exporttrace.SpanData
+		for _, s := range spans.GetSpans() {
+			if s.Name == "proxy" {
+				span = s
+			}
+		}
+		Expect(span).ToNot(BeNil())
+		Expect(span.SpanKind).To(Equal(trace.SpanKindClient))
+		Expect(span.Attributes).To(ContainElement(label.String("pistache.upstream", upstreamFor(upstream).Name())))
+
+		// The upstream sees the proxy span as its parent
+		Expect(<-traceparent).To(Equal(fmt.Sprintf("00-%s-%s-01", span.SpanContext.TraceID, span.SpanContext.SpanID)))
+	})
+})
+
+var _ = Describe("Proxy upstream discovery", func() {
+	var (
+		a, b, c *testUpstream
+		file    string
+	)
+
+	BeforeEach(func() {
+		a = newTestUpstream("a")
+		b = newTestUpstream("b")
+		c = newTestUpstream("c")
+
+		f, err := ioutil.TempFile("", "upstreams-*.yaml")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(f.Close()).To(Succeed())
+		file = f.Name()
+	})
+
+	AfterEach(func() {
+		a.Close()
+		b.Close()
+		c.Close()
+		Expect(os.Remove(file)).To(Succeed())
+	})
+
+	writeUpstreams := func(modTime time.Time, upstreams ...*testUpstream) {
+		content := ""
+		for _, u := range upstreams {
+			upstream := upstreamFor(u.Server)
+			content += fmt.Sprintf("- host: %s\n  port: %d\n", upstream.Host, upstream.Port)
+		}
+		Expect(ioutil.WriteFile(file, []byte(content), 0600)).To(Succeed())
+		Expect(os.Chtimes(file, modTime, modTime)).To(Succeed())
+	}
+
+	upstreamNames := func(p services.Proxy) func() []string {
+		return func() []string {
+			var names []string
+			for _, s := range p.Upstreams() {
+				names = append(names, s.Name)
+			}
+			return names
+		}
+	}
+
+	It("should follow the upstreams listed in a file", func() {
+		writeUpstreams(time.Now().Add(-time.Minute), a)
+		p, err := services.NewProxy(services.ProxyConfig{PoolConfig: services.PoolConfig{
+			Upstreams: []services.Upstream{upstreamFor(b.Server)},
+			Discovery: &services.DiscoveryConfig{File: file, Interval: 1},
+		}})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(upstreamNames(p)()).To(ConsistOf(upstreamFor(a.Server).Name(), upstreamFor(b.Server).Name()))
+
+		writeUpstreams(time.Now(), c)
+		Eventually(upstreamNames(p), 3*time.Second).Should(ConsistOf(upstreamFor(b.Server).Name(), upstreamFor(c.Server).Name()))
+		for i := 0; i < 4; i++ {
+			Expect(proxyRequest(p)).To(Or(Equal("b"), Equal("c")))
+		}
+	})
+
+	It("should follow the file while the DNS resolution fails", func() {
+		writeUpstreams(time.Now().Add(-time.Minute), a)
+		p, err := services.NewProxy(services.ProxyConfig{PoolConfig: services.PoolConfig{
+			Discovery: &services.DiscoveryConfig{
+				DNS:          &services.DNSDiscoveryConfig{Name: "upstreams.invalid", Port: 8000},
+				File:         file,
+				Interval:     60,
+				FileInterval: 1,
+			},
+		}})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(upstreamNames(p)()).To(ConsistOf(upstreamFor(a.Server).Name()))
+
+		writeUpstreams(time.Now(), b)
+		Eventually(upstreamNames(p), 3*time.Second).Should(ConsistOf(upstreamFor(b.Server).Name()))
+	})
+
+	It("should resolve the upstreams from DNS", func() {
+		upstream := upstreamFor(a.Server)
+		p, err := services.NewProxy(services.ProxyConfig{PoolConfig: services.PoolConfig{
+			Discovery: &services.DiscoveryConfig{DNS: &services.DNSDiscoveryConfig{Name: "localhost", Port: upstream.Port}},
+		}})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(upstreamNames(p)()).To(ContainElement(upstream.Name()))
+	})
+
+	It("should refuse a discovery without source", func() {
+		_, err := services.NewProxy(services.ProxyConfig{PoolConfig: services.PoolConfig{
+			Discovery: &services.DiscoveryConfig{},
+		}})
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("Proxy streaming", func() {
+	var (
+		upstream *httptest.Server
+		p        services.Proxy
+	)
+
+	BeforeEach(func() {
+		upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/events":
+				if r.Header.Get("Accept") != "text/event-stream" {
+					w.WriteHeader(http.StatusNotAcceptable)
+					return
+				}
+				w.Header().Set("Content-Type", "text/event-stream")
+			case "/lines":
+				w.Header().Set("Content-Type", "application/x-ndjson")
+			case "/sized":
+				w.Header().Set("Content-Length", "27")
+			}
+			// Flushing before the end makes the response chunked
+			flush := r.URL.Path != "/dummy" && r.URL.Path != "/sized"
+			for i := 0; i < 3; i++ {
+				_, _ = fmt.Fprintf(w, "data: %d\n\n", i)
+				if flush {
+					w.(http.Flusher).Flush()
+				}
+			}
+		}))
+
+		var err error
+		p, err = services.NewProxy(services.ProxyConfig{PoolConfig: services.PoolConfig{
+			Upstreams: []services.Upstream{upstreamFor(upstream)},
+		}})
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		upstream.Close()
+	})
+
+	send := func(path, accept string) (*models.Response, *httptest.ResponseRecorder) {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		c := echo.New().NewContext(r, w)
+		c.Set("pistached", true)
+
+		response, err := p.Request(c)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(r.Header.Get("Accept")).To(Equal(accept))
+		return response, w
+	}
+
+	It("should pass an event stream through without storing it", func() {
+		response, w := send("/events", "text/event-stream")
+		Expect(response).To(BeNil())
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(w.Flushed).To(BeTrue())
+		Expect(w.Body.String()).To(Equal("data: 0\n\ndata: 1\n\ndata: 2\n\n"))
+	})
+
+	It("should not store a streamed response", func() {
+		response, w := send("/lines", "")
+		Expect(response).To(BeNil())
+		Expect(w.Flushed).To(BeTrue())
+		Expect(w.Body.String()).To(HavePrefix("data: 0"))
+	})
+
+	It("should flush a chunked response as it arrives and still store it", func() {
+		response, w := send("/chunked", "")
+		Expect(w.Flushed).To(BeTrue())
+		Expect(w.Body.String()).To(Equal("data: 0\n\ndata: 1\n\ndata: 2\n\n"))
+		Expect(response).ToNot(BeNil())
+		Expect(response.Body).To(Equal(w.Body.Bytes()))
+	})
+
+	It("should store a regular response", func() {
+		response, w := send("/dummy", "")
+		Expect(response).ToNot(BeNil())
+		Expect(response.Body).To(Equal(w.Body.Bytes()))
+	})
+
+	It("should send but not store a response larger than the limit", func() {
+		var err error
+		p, err = services.NewProxy(services.ProxyConfig{
+			PoolConfig:       services.PoolConfig{Upstreams: []services.Upstream{upstreamFor(upstream)}},
+			MaxCacheableSize: 16,
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		for _, path := range []string{"/dummy", "/sized", "/chunked"} {
+			response, w := send(path, "")
+			Expect(response).To(BeNil())
+			Expect(w.Body.String()).To(Equal("data: 0\n\ndata: 1\n\ndata: 2\n\n"))
+		}
+	})
+})
+
+var _ = Describe("Proxy balancing", func() {
+	var a, b *testUpstream
+
+	BeforeEach(func() {
+		a = newTestUpstream("a")
+		b = newTestUpstream("b")
+	})
+
+	AfterEach(func() {
+		a.Close()
+		b.Close()
+	})
+
+	newProxy := func(balancing string) services.Proxy {
+		ua := upstreamFor(a.Server)
+		ua.Weight = 3
+		p, err := services.NewProxy(services.ProxyConfig{PoolConfig: services.PoolConfig{
+			Upstreams: []services.Upstream{ua, upstreamFor(b.Server)},
+			Balancing: balancing,
+		}})
+		Expect(err).ToNot(HaveOccurred())
+		return p
+	}
+
+	It("should refuse an unknown strategy", func() {
+		_, err := services.NewProxy(services.ProxyConfig{PoolConfig: services.PoolConfig{Balancing: "fastest"}})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should spread requests by weight", func() {
+		p := newProxy(services.BalancingWeightedRoundRobin)
+
+		counts := map[string]int{}
+		for i := 0; i < 8; i++ {
+			counts[proxyRequest(p)]++
+		}
+		Expect(counts).To(Equal(map[string]int{"a": 6, "b": 2}))
+	})
+
+	It("should always send a key to the same upstream", func() {
+		p := newProxy(services.BalancingConsistentHash)
+
+		for _, key := range []string{"{test}-1-", "{test}-2-", "{test}-3-"} {
+			first := proxyRequestWithKey(p, key)
+			for i := 0; i < 3; i++ {
+				Expect(proxyRequestWithKey(p, key)).To(Equal(first))
+			}
+		}
+	})
+
+	It("should use every upstream with the least requests", func() {
+		for _, balancing := range []string{services.BalancingLeastRequests, services.BalancingRandomTwoChoices} {
+			p := newProxy(balancing)
+			for i := 0; i < 4; i++ {
+				Expect(proxyRequest(p)).To(Or(Equal("a"), Equal("b")))
+			}
+			for _, s := range p.Upstreams() {
+				Expect(s.InFlight).To(BeZero())
+			}
+		}
+	})
+})
+
+var _ = Describe("Proxy routing", func() {
+	var (
+		web, api, admin *testUpstream
+		p               services.Proxy
+	)
+
+	BeforeEach(func() {
+		web = newTestUpstream("web")
+		api = newTestUpstream("api")
+		admin = newTestUpstream("admin")
+
+		var err error
+		p, err = services.NewProxy(services.ProxyConfig{
+			PoolConfig: services.PoolConfig{
+				Upstreams: []services.Upstream{upstreamFor(web.Server)},
+			},
+			Pools: map[string]services.PoolConfig{
+				"api":   {Upstreams: []services.Upstream{upstreamFor(api.Server)}},
+				"admin": {Upstreams: []services.Upstream{upstreamFor(admin.Server)}},
+			},
+			Routes: []services.RouteConfig{
+				{Host: "*.example.com", Headers: map[string]string{"x-team": "ops"}, Pool: "admin"},
+				{PathPrefix: "/api/", Pool: "api", Rewrite: map[string]string{"/api/*": "/$1"}},
+				{PathRegex: "^/v[0-9]+/", Pool: "api", Name: "versioned"},
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		web.Close()
+		api.Close()
+		admin.Close()
+	})
+
+	send := func(host, path string, header http.Header) string {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Host = host
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		c := echo.New().NewContext(r, w)
+
+		_, err := p.Request(c)
+		Expect(err).ToNot(HaveOccurred())
+
+		return w.Body.String()
+	}
+
+	It("should route on path prefix and regex", func() {
+		Expect(send("pistache", "/api/users", nil)).To(Equal("api"))
+		Expect(send("pistache", "/v2/users", nil)).To(Equal("api"))
+		Expect(send("pistache", "/users", nil)).To(Equal("web"))
+	})
+
+	It("should route on host and headers", func() {
+		ops := http.Header{"X-Team": {"ops"}}
+		Expect(send("admin.example.com:8080", "/users", ops)).To(Equal("admin"))
+		Expect(send("admin.example.com", "/users", nil)).To(Equal("web"))
+		Expect(send("example.org", "/users", ops)).To(Equal("web"))
+	})
+
+	It("should name the routes", func() {
+		Expect(p.Route(httptest.NewRequest(http.MethodGet, "/api/users", nil))).To(Equal("api"))
+		Expect(p.Route(httptest.NewRequest(http.MethodGet, "/v2/users", nil))).To(Equal("versioned"))
+		Expect(p.Route(httptest.NewRequest(http.MethodGet, "/users", nil))).To(Equal(services.DefaultPool))
+	})
+
+	It("should list the upstreams of every pool", func() {
+		pools := []string{}
+		for _, s := range p.Upstreams() {
+			pools = append(pools, s.Pool)
+		}
+		Expect(pools).To(Equal([]string{"admin", "api", "default"}))
+	})
+
+	It("should refuse a route to an unknown pool", func() {
+		_, err := services.NewProxy(services.ProxyConfig{
+			Routes: []services.RouteConfig{{PathPrefix: "/", Pool: "missing"}},
+		})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should fail when the pool has no upstreams", func() {
+		p, err := services.NewProxy(services.ProxyConfig{})
+		Expect(err).ToNot(HaveOccurred())
+
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), httptest.NewRecorder())
+		_, err = p.Request(c)
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("Proxy HTTPS upstreams", func() {
+	var (
+		server *httptest.Server
+		caFile string
+		// upgrades are the upgrade requests the upstream got
+		upgrades chan *http.Request
+	)
+
+	BeforeEach(func() {
+		upgrades = make(chan *http.Request, 1)
+		server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Upgrade") != "websocket" {
+				_, _ = w.Write([]byte("secure"))
+				return
+			}
+			upgrades <- r
+
+			// Echo the lines sent over the switched connection
+			conn, rw, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+			_ = rw.Flush()
+			for {
+				line, err := rw.ReadString('\n')
+				if err != nil {
+					return
+				}
+				_, _ = rw.WriteString("echo: " + line)
+				_ = rw.Flush()
+			}
+		}))
+
+		f, err := ioutil.TempFile("", "pistache-ca-*.pem")
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close()
+		Expect(pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})).To(Succeed())
+		caFile = f.Name()
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.Remove(caFile)
+	})
+
+	newProxy := func(tlsConf *services.UpstreamTLSConfig) (services.Proxy, error) {
+		upstream := upstreamFor(server)
+		upstream.Scheme = "https"
+		return services.NewProxy(services.ProxyConfig{PoolConfig: services.PoolConfig{
+			Upstreams: []services.Upstream{upstream},
+			TLS:       tlsConf,
+		}})
+	}
+
+	It("should verify the upstream with the configured CA", func() {
+		p, err := newProxy(&services.UpstreamTLSConfig{CA: caFile, ServerName: "example.com"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(proxyRequest(p)).To(Equal("secure"))
+	})
+
+	It("should fail with an unknown CA", func() {
+		p, err := newProxy(nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), httptest.NewRecorder())
+		_, err = p.Request(c)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should skip the verification if asked to", func() {
+		p, err := newProxy(&services.UpstreamTLSConfig{InsecureSkipVerify: true})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(proxyRequest(p)).To(Equal("secure"))
+	})
+
+	It("should upgrade WebSockets through the pool transport", func() {
+		p, err := newProxy(&services.UpstreamTLSConfig{CA: caFile, ServerName: "example.com"})
+		Expect(err).ToNot(HaveOccurred())
+
+		front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c := echo.New().NewContext(r, w)
+			c.Set("pistached", true)
+			response, err := p.Request(c)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(response).To(BeNil())
+		}))
+		defer front.Close()
+
+		conn, err := net.Dial("tcp", front.Listener.Addr().String())
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		_, err = io.WriteString(conn, "GET /socket HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		Expect(err).ToNot(HaveOccurred())
+
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(resp.StatusCode).To(Equal(http.StatusSwitchingProtocols))
+
+		var upgrade *http.Request
+		Eventually(upgrades).Should(Receive(&upgrade))
+		// The upgrade went over TLS, with the trace context
+		Expect(upgrade.TLS).ToNot(BeNil())
+		Expect(upgrade.Header.Get("traceparent")).ToNot(BeEmpty())
+
+		_, err = io.WriteString(conn, "ping\n")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(br.ReadString('\n')).To(Equal("echo: ping\n"))
+	})
+
+	It("should refuse a client certificate without key", func() {
+		_, err := newProxy(&services.UpstreamTLSConfig{Cert: caFile})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should refuse an unknown scheme", func() {
+		_, err := services.Upstream{Host: "localhost", Port: 8000, Scheme: "ftp"}.URL()
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,151 @@
+// Package services has the readiness of the app
+package services
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+const defaultReadinessTimeout = 1000
+
+// Dependencies of the readiness
+const (
+	DependencyWarmUp    = "warmup"
+	DependencyUpstreams = "upstreams"
+	DependencyShutdown  = "shutdown"
+)
+
+// ReadinessConfig contains the options of the readiness checks
+type ReadinessConfig struct {
+	// Redis fails the readiness when Redis can't be reached. Otherwise it's
+	// only reported, as the cache falls back to the memory
+	Redis bool `yaml:"redis"`
+	// Timeout of the checks of the cache tiers, in milliseconds
+	Timeout int `yaml:"timeout"`
+}
+
+// DependencyStatus describes the state of a dependency of the readiness
+type DependencyStatus struct {
+	Name    string `json:"name"`
+	Healthy bool   `json:"healthy"`
+	// Required tells if the dependency failing fails the readiness
+	Required bool   `json:"required"`
+	Message  string `json:"message,omitempty"`
+}
+
+// ReadinessReport tells if the app can serve traffic, and why
+type ReadinessReport struct {
+	Ready        bool               `json:"ready"`
+	Dependencies []DependencyStatus `json:"dependencies"`
+}
+
+// Readiness checks if the app can serve traffic
+type Readiness interface {
+	Check(context.Context) *ReadinessReport
+	// Drain fails the readiness for good, for the app to stop getting
+	// traffic before it shuts down
+	Drain()
+}
+
+type readiness struct {
+	proxy        Proxy
+	cache        Cache
+	requireRedis bool
+	timeout      time.Duration
+	draining     int32
+}
+
+// NewReadiness creates the readiness checks of the proxy and the cache
+func NewReadiness(conf ReadinessConfig, proxy Proxy, cache Cache) Readiness {
+	if conf.Timeout <= 0 {
+		conf.Timeout = defaultReadinessTimeout
+	}
+
+	return &readiness{
+		proxy:        proxy,
+		cache:        cache,
+		requireRedis: conf.Redis,
+		timeout:      milliseconds(conf.Timeout),
+	}
+}
+
+// Check reports the state of the dependencies. The app is ready when the
+// upstreams were probed, at least one of them is healthy and the required
+// cache tiers can be reached
+func (r *readiness) Check(ctx context.Context) *ReadinessReport {
+	warmUp := DependencyStatus{Name: DependencyWarmUp, Required: true, Healthy: r.proxy.WarmedUp()}
+	if !warmUp.Healthy {
+		warmUp.Message = "probing the upstreams"
+	}
+
+	var healthy int
+	upstreams := r.proxy.Upstreams()
+	for _, u := range upstreams {
+		if u.Healthy && !u.Ejected {
+			healthy++
+		}
+	}
+	upstreamsStatus := DependencyStatus{
+		Name:     DependencyUpstreams,
+		Required: true,
+		Healthy:  healthy > 0,
+		Message:  fmt.Sprintf("%d of %d upstreams healthy", healthy, len(upstreams)),
+	}
+
+	report := &ReadinessReport{Dependencies: []DependencyStatus{warmUp, upstreamsStatus}}
+	if atomic.LoadInt32(&r.draining) == 1 {
+		report.Dependencies = append(report.Dependencies, DependencyStatus{
+			Name:     DependencyShutdown,
+			Required: true,
+			Message:  "shutting down",
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	tiers := r.cache.Ping(ctx)
+	names := make([]string, 0, len(tiers))
+	for name := range tiers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		status := DependencyStatus{
+			Name:     name,
+			Healthy:  tiers[name] == nil,
+			Required: name != TierRedis || r.requireRedis,
+		}
+		if tiers[name] != nil {
+			status.Message = tiers[name].Error()
+		}
+		report.Dependencies = append(report.Dependencies, status)
+	}
+
+	report.Ready = true
+	for _, d := range report.Dependencies {
+		if d.Required && !d.Healthy {
+			report.Ready = false
+		}
+	}
+
+	return report
+}
+
+// Drain fails the readiness for good
+func (r *readiness) Drain() {
+	atomic.StoreInt32(&r.draining, 1)
+}
+
+// Ping checks every tier can be reached, by name
+func (c *cache) Ping(ctx context.Context) map[string]error {
+	tiers := c.tiers()
+	errs := make(map[string]error, len(tiers))
+	for _, t := range tiers {
+		errs[t.name] = t.repo.Ping(ctx)
+	}
+
+	return errs
+}
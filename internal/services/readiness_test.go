@@ -0,0 +1,115 @@
+package services_test
+
+import (
+	"context"
+
+	"github.com/mfamador/pistache/internal/datasources/caches"
+	"github.com/mfamador/pistache/internal/services"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Readiness", func() {
+	var (
+		upstream *testUpstream
+		p        services.Proxy
+		c        services.Cache
+	)
+
+	BeforeEach(func() {
+		upstream = newTestUpstream("a")
+
+		var err error
+		p, err = services.NewProxy(services.ProxyConfig{PoolConfig: services.PoolConfig{
+			Upstreams: []services.Upstream{upstreamFor(upstream.Server)},
+			HealthCheck: &services.HealthCheckConfig{
+				Interval:           1,
+				HealthyThreshold:   1,
+				UnhealthyThreshold: 1,
+			},
+		}})
+		Expect(err).ToNot(HaveOccurred())
+
+		c, err = services.NewCache(cf)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		upstream.Close()
+	})
+
+	dependency := func(report *services.ReadinessReport, name string) services.DependencyStatus {
+		for _, d := range report.Dependencies {
+			if d.Name == name {
+				return d
+			}
+		}
+		Fail("no dependency " + name)
+		return services.DependencyStatus{}
+	}
+
+	It("should be ready once the upstreams are probed", func() {
+		r := services.NewReadiness(services.ReadinessConfig{}, p, c)
+
+		Eventually(func() bool { return r.Check(context.Background()).Ready }).Should(BeTrue())
+
+		report := r.Check(context.Background())
+		Expect(dependency(report, services.DependencyWarmUp).Healthy).To(BeTrue())
+		Expect(dependency(report, services.DependencyUpstreams).Message).To(Equal("1 of 1 upstreams healthy"))
+		Expect(dependency(report, services.TierMemory).Healthy).To(BeTrue())
+	})
+
+	It("should not be ready without a healthy upstream", func() {
+		upstream.setHealthy(false)
+		r := services.NewReadiness(services.ReadinessConfig{}, p, c)
+
+		Eventually(func() bool {
+			return dependency(r.Check(context.Background()), services.DependencyUpstreams).Healthy
+		}, "3s").Should(BeFalse())
+		Expect(r.Check(context.Background()).Ready).To(BeFalse())
+	})
+
+	It("should not be ready once draining", func() {
+		r := services.NewReadiness(services.ReadinessConfig{}, p, c)
+		Eventually(func() bool { return r.Check(context.Background()).Ready }).Should(BeTrue())
+
+		r.Drain()
+
+		report := r.Check(context.Background())
+		Expect(report.Ready).To(BeFalse())
+		Expect(dependency(report, services.DependencyShutdown).Healthy).To(BeFalse())
+	})
+
+	Context("with an unreachable Redis", func() {
+		BeforeEach(func() {
+			conf := *cf
+			conf.Redis = &caches.RedisConfig{Servers: []struct {
+				Host string `yaml:"host"`
+				Port int    `yaml:"port"`
+			}{{Host: "127.0.0.1", Port: 1}}}
+
+			var err error
+			c, err = services.NewCache(&conf)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("should only report it if not required", func() {
+			r := services.NewReadiness(services.ReadinessConfig{}, p, c)
+
+			Eventually(func() bool { return r.Check(context.Background()).Ready }).Should(BeTrue())
+			redis := dependency(r.Check(context.Background()), services.TierRedis)
+			Expect(redis.Healthy).To(BeFalse())
+			Expect(redis.Required).To(BeFalse())
+			Expect(redis.Message).ToNot(BeEmpty())
+		})
+
+		It("should not be ready if required", func() {
+			r := services.NewReadiness(services.ReadinessConfig{Redis: true}, p, c)
+
+			Eventually(func() bool {
+				return dependency(r.Check(context.Background()), services.DependencyWarmUp).Healthy
+			}).Should(BeTrue())
+			Expect(r.Check(context.Background()).Ready).To(BeFalse())
+		})
+	})
+})
@@ -0,0 +1,214 @@
+// Package services has the upstream retries
+package services
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	defaultRetryAttempts    = 2
+	defaultRetryBudget      = 20
+	defaultRetryBaseBackoff = 25
+	defaultRetryMaxBackoff  = 250
+	// retryBudgetBurst is the number of retries the budget can save up
+	retryBudgetBurst = 10
+)
+
+type contextKey string
+
+// retryContextKey is where the proxy stores the retry state in the context
+// of a request
+const retryContextKey contextKey = "retry"
+
+var errRetryableStatus = errors.New("retryable status")
+
+var upstreamRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "pistache_upstream_retries_total",
+	Help: "Number of requests retried on another upstream target",
+}, []string{"pool"})
+
+// idempotentMethods can be safely sent again. See RFC 7231, section 4.2.2
+var idempotentMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodOptions,
+	http.MethodTrace,
+	http.MethodPut,
+	http.MethodDelete,
+}
+
+// RetryConfig contains the retry options of a pool. Only requests with an
+// idempotent method and no body are retried, on a different target if any
+type RetryConfig struct {
+	// Attempts is the maximum number of retries of a request
+	Attempts int `yaml:"attempts"`
+	// OnStatus lists the upstream status codes that are retried, on top of
+	// connection errors
+	OnStatus []int `yaml:"onStatus"`
+	// Budget is the maximum percentage of requests that can be retries
+	Budget int `yaml:"budget"`
+	// BaseBackoff and MaxBackoff, in milliseconds, bound the jittered
+	// exponential back-off between attempts
+	BaseBackoff int `yaml:"baseBackoff"`
+	MaxBackoff  int `yaml:"maxBackoff"`
+}
+
+// retryPolicy decides which requests of a pool are retried
+type retryPolicy struct {
+	conf RetryConfig
+	pool string
+
+	mutex  sync.Mutex
+	tokens float64
+	random *rand.Rand
+}
+
+func newRetryPolicy(pool string, conf RetryConfig) *retryPolicy {
+	if conf.Attempts <= 0 {
+		conf.Attempts = defaultRetryAttempts
+	}
+	if conf.Budget <= 0 {
+		conf.Budget = defaultRetryBudget
+	}
+	if conf.BaseBackoff <= 0 {
+		conf.BaseBackoff = defaultRetryBaseBackoff
+	}
+	if conf.MaxBackoff <= 0 {
+		conf.MaxBackoff = defaultRetryMaxBackoff
+	}
+
+	return &retryPolicy{
+		conf:   conf,
+		pool:   pool,
+		tokens: retryBudgetBurst,
+		random: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// deposit adds the share of a request to the retry budget
+func (p *retryPolicy) deposit() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.tokens += float64(p.conf.Budget) / 100
+	if p.tokens > retryBudgetBurst {
+		p.tokens = retryBudgetBurst
+	}
+}
+
+// withdraw takes a retry from the budget, if there is one left
+func (p *retryPolicy) withdraw() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.tokens < 1 {
+		return false
+	}
+	p.tokens--
+
+	return true
+}
+
+// backoff returns the full jitter back-off before a retry
+func (p *retryPolicy) backoff(retry int) time.Duration {
+	backoff := time.Duration(p.conf.BaseBackoff) * time.Millisecond
+	maxBackoff := time.Duration(p.conf.MaxBackoff) * time.Millisecond
+	for i := 1; i < retry && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return time.Duration(p.random.Int63n(int64(backoff) + 1))
+}
+
+func (p *retryPolicy) retriesStatus(status int) bool {
+	for _, v := range p.conf.OnStatus {
+		if v == status {
+			return true
+		}
+	}
+
+	return false
+}
+
+// retryState is the retry state of a single request
+type retryState struct {
+	policy    *retryPolicy
+	eligible  bool
+	retries   int
+	scheduled bool
+	tried     []string
+}
+
+func newRetryState(p *retryPolicy, c echo.Context) *retryState {
+	req := c.Request()
+	p.deposit()
+
+	return &retryState{
+		policy:   p,
+		eligible: contains(req.Method, idempotentMethods) && req.ContentLength == 0 && !c.IsWebSocket(),
+	}
+}
+
+// schedule reserves a retry, if the request can still be retried
+func (s *retryState) schedule() bool {
+	if s.scheduled {
+		return true
+	}
+
+	if !s.eligible || s.retries >= s.policy.conf.Attempts || !s.policy.withdraw() {
+		return false
+	}
+
+	s.scheduled = true
+	upstreamRetries.WithLabelValues(s.policy.pool).Inc()
+
+	return true
+}
+
+// untried returns the targets not tried yet, or all of them if every
+// target was tried
+func (s *retryState) untried(targets []*upstreamTarget) []*upstreamTarget {
+	if len(s.tried) == 0 {
+		return targets
+	}
+
+	untried := make([]*upstreamTarget, 0, len(targets))
+	for _, t := range targets {
+		if !contains(t.Name, s.tried) {
+			untried = append(untried, t)
+		}
+	}
+
+	if len(untried) == 0 {
+		return targets
+	}
+
+	return untried
+}
+
+// retryOnStatus is a proxy ModifyResponse hook failing the responses whose
+// status should be retried, as long as the request can be retried
+func retryOnStatus(resp *http.Response) error {
+	s, ok := resp.Request.Context().Value(retryContextKey).(*retryState)
+	if !ok || !s.policy.retriesStatus(resp.StatusCode) || !s.schedule() {
+		return nil
+	}
+
+	resp.Body.Close()
+
+	return errRetryableStatus
+}
@@ -0,0 +1,130 @@
+// Package services has the routing of requests to upstream pools
+package services
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// RouteConfig matches requests to send them to a pool. Every condition that
+// is set must match
+type RouteConfig struct {
+	// Name of the route in metrics. Defaults to the name of the pool
+	Name string `yaml:"name"`
+	// Host of the request, without the port. A leading "*." matches any
+	// subdomain
+	Host string `yaml:"host"`
+	// PathPrefix of the request
+	PathPrefix string `yaml:"pathPrefix"`
+	// PathRegex of the request
+	PathRegex string `yaml:"pathRegex"`
+	// Headers and their exact values
+	Headers map[string]string `yaml:"headers"`
+	// Pool the requests are sent to
+	Pool string `yaml:"pool"`
+	// Rewrite rules of the path, where the values captured in asterisks can
+	// be retrieved by index, e.g. "/api/*": "/$1"
+	Rewrite map[string]string `yaml:"rewrite"`
+}
+
+// route sends the matching requests to a pool
+type route struct {
+	name       string
+	host       string
+	pathPrefix string
+	pathRegex  *regexp.Regexp
+	headers    map[string]string
+	pool       *pool
+	handler    echo.HandlerFunc
+}
+
+func newRoute(conf RouteConfig, pools map[string]*pool) (*route, error) {
+	p, ok := pools[conf.Pool]
+	if !ok {
+		return nil, fmt.Errorf("route to unknown pool %q", conf.Pool)
+	}
+
+	r := &route{
+		name:       conf.Name,
+		host:       strings.ToLower(conf.Host),
+		pathPrefix: conf.PathPrefix,
+		headers:    make(map[string]string, len(conf.Headers)),
+		pool:       p,
+		handler:    proxyHandler(p, conf.Rewrite),
+	}
+
+	if r.name == "" {
+		r.name = conf.Pool
+	}
+
+	if conf.PathRegex != "" {
+		re, err := regexp.Compile(conf.PathRegex)
+		if err != nil {
+			return nil, err
+		}
+		r.pathRegex = re
+	}
+
+	for k, v := range conf.Headers {
+		r.headers[http.CanonicalHeaderKey(k)] = v
+	}
+
+	return r, nil
+}
+
+// proxyHandler returns the handler proxying requests to a pool
+func proxyHandler(p *pool, rewrite map[string]string) echo.HandlerFunc {
+	config := middleware.ProxyConfig{
+		Balancer:   p.balancer,
+		Rewrite:    rewrite,
+		ContextKey: targetContextKey,
+		Transport:  upstreamTransport{p.transport},
+	}
+
+	if p.retry != nil {
+		config.ModifyResponse = retryOnStatus
+	}
+
+	return middleware.ProxyWithConfig(config)(noop)
+}
+
+func (r *route) matches(req *http.Request) bool {
+	if r.host != "" && !matchHost(r.host, req.Host) {
+		return false
+	}
+
+	if r.pathPrefix != "" && !strings.HasPrefix(req.URL.Path, r.pathPrefix) {
+		return false
+	}
+
+	if r.pathRegex != nil && !r.pathRegex.MatchString(req.URL.Path) {
+		return false
+	}
+
+	for k, v := range r.headers {
+		if req.Header.Get(k) != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+func matchHost(pattern, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+
+	return host == pattern
+}
@@ -1,8 +1,34 @@
 // Package services defines the base service
 package services
 
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel/api/trace"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/label"
+)
+
+// Span attributes of the services
+const (
+	tierLabel     = label.Key("pistache.cache.tier")
+	resultLabel   = label.Key("pistache.cache.result")
+	poolLabel     = label.Key("pistache.pool")
+	upstreamLabel = label.Key("pistache.upstream")
+)
+
+var tracer = global.Tracer("github.com/mfamador/pistache/internal/services")
+
+// recordError flags a span as failed
+func recordError(ctx context.Context, span trace.Span, err error) {
+	span.RecordError(ctx, err, trace.WithErrorStatus(codes.Error))
+}
+
 // Config contains the configuration options for all the services
 type Config struct {
 	Cache CacheConfig `yaml:"cache"`
 	Proxy ProxyConfig `yaml:"proxy"`
+	// Readiness contains the options of the readiness probe
+	Readiness ReadinessConfig `yaml:"readiness"`
 }
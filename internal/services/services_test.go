@@ -8,13 +8,64 @@ import (
 	_ "github.com/mfamador/pistache/internal/logger"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel/propagators"
+	"go.opentelemetry.io/otel/sdk/export/trace/tracetest"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
 var (
 	TestConfigDir = fmt.Sprintf("%s/test", config.Dir)
+	// spans records the spans of every test
+	spans = tracetest.NewInMemoryExporter()
 )
 
+// spanNames returns the names of the recorded spans
+func spanNames() []string {
+	var names []string
+	for _, s := range spans.GetSpans() {
+		names = append(names, s.Name)
+	}
+
+	return names
+}
+
+// metricValue returns the value of a counter or gauge with the given labels,
+// or 0 if it wasn't recorded
+func metricValue(name string, labels map[string]string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	Expect(err).ToNot(HaveOccurred())
+
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+
+	metrics:
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if v, ok := labels[l.GetName()]; ok && v != l.GetValue() {
+					continue metrics
+				}
+			}
+			if m.GetCounter() != nil {
+				return m.GetCounter().GetValue()
+			}
+			return m.GetGauge().GetValue()
+		}
+	}
+
+	return 0
+}
+
 func TestCache(t *testing.T) {
+	global.SetTracerProvider(sdktrace.NewTracerProvider(
+		sdktrace.WithConfig(sdktrace.Config{DefaultSampler: sdktrace.AlwaysSample()}),
+		sdktrace.WithSyncer(spans),
+	))
+	global.SetTextMapPropagator(propagators.TraceContext{})
+
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "Cache Suite")
 }
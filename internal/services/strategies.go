@@ -0,0 +1,165 @@
+// Package services has the upstream load balancing strategies
+package services
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Load balancing strategies
+const (
+	// BalancingRoundRobin picks the targets in turn
+	BalancingRoundRobin = "roundRobin"
+	// BalancingWeightedRoundRobin picks the targets in turn, proportionally
+	// to their weight
+	BalancingWeightedRoundRobin = "weightedRoundRobin"
+	// BalancingLeastRequests picks the target with the least requests in flight
+	BalancingLeastRequests = "leastRequests"
+	// BalancingRandomTwoChoices picks the target with the least requests in
+	// flight among two random ones
+	BalancingRandomTwoChoices = "randomTwoChoices"
+	// BalancingConsistentHash always picks the same target for a cache key
+	BalancingConsistentHash = "consistentHash"
+)
+
+// CacheKeyContextKey is where the cache handler stores the key of a request
+const CacheKeyContextKey = "cacheKey"
+
+// strategy picks one of the available targets for a request
+type strategy interface {
+	pick(c echo.Context, targets []*upstreamTarget) *upstreamTarget
+}
+
+func newStrategy(name string) (strategy, error) {
+	switch name {
+	case "", BalancingRoundRobin:
+		return &roundRobin{}, nil
+	case BalancingWeightedRoundRobin:
+		return &weightedRoundRobin{}, nil
+	case BalancingLeastRequests:
+		return leastRequests{}, nil
+	case BalancingRandomTwoChoices:
+		return &randomTwoChoices{random: rand.New(rand.NewSource(time.Now().UnixNano()))}, nil
+	case BalancingConsistentHash:
+		return consistentHash{}, nil
+	default:
+		return nil, fmt.Errorf("invalid balancing strategy %q", name)
+	}
+}
+
+type roundRobin struct {
+	i uint32
+}
+
+func (s *roundRobin) pick(c echo.Context, targets []*upstreamTarget) *upstreamTarget {
+	i := atomic.AddUint32(&s.i, 1)
+
+	return targets[(i-1)%uint32(len(targets))]
+}
+
+// weightedRoundRobin is the smooth weighted round robin used by nginx, which
+// spreads the picks of heavier targets instead of sending them in bursts
+type weightedRoundRobin struct {
+	mutex sync.Mutex
+}
+
+func (s *weightedRoundRobin) pick(c echo.Context, targets []*upstreamTarget) *upstreamTarget {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var best *upstreamTarget
+	total := 0
+	for _, t := range targets {
+		t.currentWeight += t.weight
+		total += t.weight
+		if best == nil || t.currentWeight > best.currentWeight {
+			best = t
+		}
+	}
+	best.currentWeight -= total
+
+	return best
+}
+
+type leastRequests struct{}
+
+func (leastRequests) pick(c echo.Context, targets []*upstreamTarget) *upstreamTarget {
+	best := targets[0]
+	for _, t := range targets[1:] {
+		if t.inFlight() < best.inFlight() {
+			best = t
+		}
+	}
+
+	return best
+}
+
+type randomTwoChoices struct {
+	mutex  sync.Mutex
+	random *rand.Rand
+}
+
+func (s *randomTwoChoices) pick(c echo.Context, targets []*upstreamTarget) *upstreamTarget {
+	if len(targets) == 1 {
+		return targets[0]
+	}
+
+	s.mutex.Lock()
+	i := s.random.Intn(len(targets))
+	j := s.random.Intn(len(targets) - 1)
+	s.mutex.Unlock()
+	if j >= i {
+		j++
+	}
+
+	if targets[j].inFlight() < targets[i].inFlight() {
+		return targets[j]
+	}
+
+	return targets[i]
+}
+
+// consistentHash uses weighted rendezvous hashing, so only the keys of a
+// target leaving the rotation move to other targets
+type consistentHash struct{}
+
+func (consistentHash) pick(c echo.Context, targets []*upstreamTarget) *upstreamTarget {
+	key, _ := c.Get(CacheKeyContextKey).(string)
+	if key == "" {
+		key = c.Request().URL.RequestURI()
+	}
+
+	var best *upstreamTarget
+	bestScore := math.Inf(-1)
+	for _, t := range targets {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(key))
+		_, _ = h.Write([]byte(t.Name))
+		// Map the hash to (0, 1) and weight it
+		u := (float64(mix64(h.Sum64())>>11) + 0.5) / (1 << 53)
+		score := -float64(t.weight) / math.Log(u)
+		if score > bestScore {
+			best, bestScore = t, score
+		}
+	}
+
+	return best
+}
+
+// mix64 is the murmur3 finalizer, so similar inputs get unrelated scores
+func mix64(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+
+	return x
+}
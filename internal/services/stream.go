@@ -0,0 +1,159 @@
+// Package services has the streaming of proxied responses
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+)
+
+const mimeEventStream = "text/event-stream"
+
+// HoldContextKey asks the proxy to hold a cacheable 200 response back instead
+// of sending it, for the caller to answer a range from it
+const HoldContextKey = "holdResponse"
+
+// streamingContentTypes are sent as they're produced and never end, or not
+// soon enough to be cached
+var streamingContentTypes = []string{
+	mimeEventStream,
+	"application/x-ndjson",
+	"application/stream+json",
+	"multipart/x-mixed-replace",
+}
+
+// isStreamingRequest tells if a request asks for a protocol upgrade or a
+// stream of events
+func isStreamingRequest(req *http.Request) bool {
+	if req.Header.Get("Upgrade") != "" && headerHasToken(req.Header, "Connection", "upgrade") {
+		return true
+	}
+
+	for _, v := range req.Header.Values(echo.HeaderAccept) {
+		for _, accepted := range strings.Split(v, ",") {
+			if mediaType(accepted) == mimeEventStream {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// isStreamingResponse tells if a response switches protocols, is a stream,
+// or if the upstream asked not to buffer it. Bodies of unknown length are
+// flushed as they arrive by the reverse proxy, but can still be cached
+func isStreamingResponse(status int, header http.Header) bool {
+	return status == http.StatusSwitchingProtocols ||
+		contains(mediaType(header.Get(echo.HeaderContentType)), streamingContentTypes) ||
+		strings.EqualFold(header.Get("X-Accel-Buffering"), "no")
+}
+
+func mediaType(v string) string {
+	t, _, err := mime.ParseMediaType(v)
+	if err != nil {
+		return ""
+	}
+
+	return t
+}
+
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, v := range header.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// responseCapture writes a response to the client, keeping a copy of its
+// body for the cache if asked to. The copy is given up once it exceeds the
+// limit. Streaming responses aren't copied, and are flushed as they're
+// written. If asked to hold it, a cacheable 200 response of known size is only
+// copied
+type responseCapture struct {
+	http.ResponseWriter
+	logger    *zerolog.Logger
+	keep      bool
+	limit     int64
+	body      bytes.Buffer
+	streaming bool
+	hold      bool
+	// held is set when the response wasn't sent
+	held bool
+}
+
+func (w *responseCapture) WriteHeader(code int) {
+	if isStreamingResponse(code, w.Header()) {
+		w.streaming = true
+	}
+
+	// Don't bother copying a body known to be too large
+	if size, err := strconv.ParseInt(w.Header().Get(echo.HeaderContentLength), 10, 64); err == nil && size > w.limit {
+		w.abandon()
+	}
+
+	if w.hold && w.keep && !w.streaming && code == http.StatusOK && w.Header().Get(echo.HeaderContentLength) != "" {
+		w.held = true
+		return
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseCapture) Write(b []byte) (int, error) {
+	if w.held {
+		// The size is known and within the limit
+		return w.body.Write(b)
+	}
+
+	n, err := w.ResponseWriter.Write(b)
+	if w.streaming {
+		w.Flush()
+		return n, err
+	}
+
+	if w.keep && int64(w.body.Len()+n) > w.limit {
+		w.abandon()
+	}
+	if w.keep {
+		w.body.Write(b[:n])
+	}
+
+	return n, err
+}
+
+// abandon stops copying the body, which is too large to be cached
+func (w *responseCapture) abandon() {
+	if w.keep {
+		w.logger.Debug().Int64("limit", w.limit).Msg("Response too large to cache")
+	}
+	w.keep = false
+	w.body = bytes.Buffer{}
+}
+
+func (w *responseCapture) Flush() {
+	if w.held {
+		return
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *responseCapture) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	// A hijacked connection is never cached
+	w.streaming = true
+	return w.ResponseWriter.(http.Hijacker).Hijack()
+}
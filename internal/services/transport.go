@@ -0,0 +1,232 @@
+// Package services has the transport to the upstreams
+package services
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/api/global"
+)
+
+const (
+	defaultDialTimeout           = 5000
+	defaultTLSHandshakeTimeout   = 10000
+	defaultResponseHeaderTimeout = 30000
+	defaultMaxIdleConns          = 100
+	defaultMaxIdleConnsPerHost   = 32
+	defaultIdleConnTimeout       = 90
+	defaultKeepAlive             = 30
+)
+
+// roundTripContextKey is where the proxy stores the outcome of an upstream
+// round trip in the context of a request
+const roundTripContextKey contextKey = "roundTrip"
+
+// ErrUpstreamTimeout is returned when an upstream didn't answer in time
+var ErrUpstreamTimeout = errors.New("upstream timed out")
+
+// TimeoutConfig contains the timeouts of upstream requests, in milliseconds.
+// A negative value disables a timeout
+type TimeoutConfig struct {
+	// Dial is the time to establish a connection
+	Dial int `yaml:"dial"`
+	// TLSHandshake is the time to complete the handshake with HTTPS upstreams
+	TLSHandshake int `yaml:"tlsHandshake"`
+	// ResponseHeader is the time to get the response headers once the request
+	// is sent
+	ResponseHeader int `yaml:"responseHeader"`
+	// Request is the total time of a request, retries included. Disabled by
+	// default, so long-lived responses aren't cut
+	Request int `yaml:"request"`
+}
+
+// ConnectionPoolConfig contains the options of the idle connections kept to
+// the upstreams
+type ConnectionPoolConfig struct {
+	// MaxIdleConns is the maximum number of idle connections to all targets
+	MaxIdleConns int `yaml:"maxIdleConns"`
+	// MaxIdleConnsPerHost is the maximum number of idle connections to a target
+	MaxIdleConnsPerHost int `yaml:"maxIdleConnsPerHost"`
+	// MaxConnsPerHost limits the connections to a target. 0 means no limit
+	MaxConnsPerHost int `yaml:"maxConnsPerHost"`
+	// IdleConnTimeout is how long, in seconds, an idle connection is kept
+	IdleConnTimeout int `yaml:"idleConnTimeout"`
+	// KeepAlive is the TCP keep-alive period, in seconds. A negative value
+	// disables TCP keep-alives
+	KeepAlive int `yaml:"keepAlive"`
+	// DisableKeepAlives uses every connection for a single request
+	DisableKeepAlives bool `yaml:"disableKeepAlives"`
+}
+
+// UpstreamTLSConfig contains the TLS options to connect to HTTPS upstreams
+type UpstreamTLSConfig struct {
+	// CA is the PEM bundle file used to verify the upstreams. If not set, the
+	// system roots are used
+	CA string `yaml:"ca"`
+	// Cert and Key are the PEM files of the client certificate, for mTLS
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// ServerName overrides the name used for SNI and verification
+	ServerName string `yaml:"serverName"`
+	// InsecureSkipVerify disables the verification of the upstreams.
+	// Only meant for development
+	InsecureSkipVerify bool `yaml:"insecureSkipVerify"`
+}
+
+// newTransport returns the transport to the upstreams of a pool
+func newTransport(conf PoolConfig) (*http.Transport, error) {
+	timeouts := conf.Timeouts
+	if timeouts.Dial == 0 {
+		timeouts.Dial = defaultDialTimeout
+	}
+	if timeouts.TLSHandshake == 0 {
+		timeouts.TLSHandshake = defaultTLSHandshakeTimeout
+	}
+	if timeouts.ResponseHeader == 0 {
+		timeouts.ResponseHeader = defaultResponseHeaderTimeout
+	}
+
+	pooling := conf.ConnectionPool
+	if pooling.MaxIdleConns <= 0 {
+		pooling.MaxIdleConns = defaultMaxIdleConns
+	}
+	if pooling.MaxIdleConnsPerHost <= 0 {
+		pooling.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	}
+	if pooling.IdleConnTimeout <= 0 {
+		pooling.IdleConnTimeout = defaultIdleConnTimeout
+	}
+	if pooling.KeepAlive == 0 {
+		pooling.KeepAlive = defaultKeepAlive
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   milliseconds(timeouts.Dial),
+		KeepAlive: time.Duration(pooling.KeepAlive) * time.Second,
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.TLSHandshakeTimeout = milliseconds(timeouts.TLSHandshake)
+	transport.ResponseHeaderTimeout = milliseconds(timeouts.ResponseHeader)
+	transport.MaxIdleConns = pooling.MaxIdleConns
+	transport.MaxIdleConnsPerHost = pooling.MaxIdleConnsPerHost
+	transport.MaxConnsPerHost = pooling.MaxConnsPerHost
+	transport.IdleConnTimeout = time.Duration(pooling.IdleConnTimeout) * time.Second
+	transport.DisableKeepAlives = pooling.DisableKeepAlives
+
+	if conf.TLS != nil {
+		tlsConfig, err := newUpstreamTLSConfig(conf.TLS)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	return transport, nil
+}
+
+func newUpstreamTLSConfig(conf *UpstreamTLSConfig) (*tls.Config, error) {
+	//nolint:gosec // Skipping verification is an explicit opt-in
+	tlsConfig := &tls.Config{
+		ServerName:         conf.ServerName,
+		InsecureSkipVerify: conf.InsecureSkipVerify,
+	}
+
+	if conf.CA != "" {
+		pem, err := ioutil.ReadFile(conf.CA)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", conf.CA)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if conf.Cert != "" || conf.Key != "" {
+		if conf.Cert == "" || conf.Key == "" {
+			return nil, errors.New("both cert and key are needed for a client certificate")
+		}
+
+		cert, err := tls.LoadX509KeyPair(conf.Cert, conf.Key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// milliseconds converts a timeout, where a negative value means none
+func milliseconds(ms int) time.Duration {
+	if ms < 0 {
+		return 0
+	}
+
+	return time.Duration(ms) * time.Millisecond
+}
+
+// roundTrip holds what the proxy middleware doesn't carry over an upstream
+// round trip
+type roundTrip struct {
+	// accept is the Accept header hidden from the proxy middleware
+	accept string
+	// upgrade is the Upgrade header of WebSocket requests, hidden from the
+	// proxy middleware
+	upgrade  string
+	timedOut bool
+}
+
+// upstreamTransport propagates the trace context, restores the Accept and
+// Upgrade headers hidden from the proxy middleware and records the upstream
+// timeouts of proxied requests
+type upstreamTransport struct {
+	*http.Transport
+}
+
+func (t upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// The outgoing request has its own copy of the headers
+	global.TextMapPropagator().Inject(req.Context(), req.Header)
+
+	rt, ok := req.Context().Value(roundTripContextKey).(*roundTrip)
+	if !ok {
+		return t.Transport.RoundTrip(req)
+	}
+
+	if rt.accept != "" {
+		req.Header.Set("Accept", rt.accept)
+	}
+	if rt.upgrade != "" {
+		// The reverse proxy checks the upgrade it gets back against these
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", rt.upgrade)
+	}
+
+	resp, err := t.Transport.RoundTrip(req)
+	if err != nil && isTimeout(err) {
+		rt.timedOut = true
+	}
+
+	return resp, err
+}
+
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var netErr net.Error
+
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,85 @@
+// Package tracing defines the OpenTelemetry tracing bootstrap
+package tracing
+
+import (
+	"context"
+	"errors"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/propagators"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/semconv"
+)
+
+const defaultServiceName = "pistache"
+
+// Config contains the tracing options. Spans are sent to an OTLP collector
+type Config struct {
+	// Endpoint of the OTLP gRPC collector, as host:port
+	Endpoint string `yaml:"endpoint"`
+	// Insecure connects to the collector without TLS
+	Insecure bool `yaml:"insecure"`
+	// Headers sent along with the spans, e.g. for authentication
+	Headers map[string]string `yaml:"headers"`
+	// ServiceName of the spans
+	ServiceName string `yaml:"serviceName"`
+	// SampleRatio is the ratio of the traces started by Pistache that are
+	// sampled, between 0 and 1. If not set, every trace is sampled. Traces
+	// started by the clients keep their decision
+	SampleRatio float64 `yaml:"sampleRatio"`
+}
+
+// Start exports the spans with the given config, returning the function
+// flushing and stopping the export. W3C trace context is propagated even if
+// tracing is disabled, with a nil config
+func Start(conf *Config) (func(context.Context) error, error) {
+	global.SetTextMapPropagator(otel.NewCompositeTextMapPropagator(propagators.TraceContext{}, propagators.Baggage{}))
+
+	if conf == nil {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	if conf.Endpoint == "" {
+		return nil, errors.New("tracing needs a collector endpoint")
+	}
+
+	opts := []otlp.ExporterOption{otlp.WithAddress(conf.Endpoint)}
+	if conf.Insecure {
+		opts = append(opts, otlp.WithInsecure())
+	}
+	if len(conf.Headers) > 0 {
+		opts = append(opts, otlp.WithHeaders(conf.Headers))
+	}
+
+	exporter, err := otlp.NewExporter(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	serviceName := conf.ServiceName
+	if serviceName == "" {
+		serviceName = defaultServiceName
+	}
+
+	sampler := sdktrace.AlwaysSample()
+	if conf.SampleRatio > 0 && conf.SampleRatio < 1 {
+		sampler = sdktrace.TraceIDRatioBased(conf.SampleRatio)
+	}
+
+	batcher := sdktrace.NewBatchSpanProcessor(exporter)
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithConfig(sdktrace.Config{DefaultSampler: sdktrace.ParentBased(sampler)}),
+		sdktrace.WithResource(resource.New(semconv.ServiceNameKey.String(serviceName))),
+		sdktrace.WithSpanProcessor(batcher),
+	)
+	global.SetTracerProvider(provider)
+
+	return func(ctx context.Context) error {
+		// Sends the spans still queued
+		provider.UnregisterSpanProcessor(batcher)
+		return exporter.Shutdown(ctx)
+	}, nil
+}
@@ -0,0 +1,104 @@
+package tracing_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/mfamador/pistache/internal/tracing"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"go.opentelemetry.io/otel/api/global"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+func TestTracing(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Tracing Suite")
+}
+
+// collectorStub is an OTLP collector recording the export calls it receives
+type collectorStub struct {
+	*grpc.Server
+	addr string
+
+	mu      sync.Mutex
+	methods []string
+	headers []metadata.MD
+}
+
+func newCollectorStub() *collectorStub {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).ToNot(HaveOccurred())
+
+	c := &collectorStub{addr: lis.Addr().String()}
+	c.Server = grpc.NewServer(grpc.UnknownServiceHandler(func(_ interface{}, stream grpc.ServerStream) error {
+		// The export request is read without its schema, and the empty
+		// response is all the exporter expects
+		if err := stream.RecvMsg(&emptypb.Empty{}); err != nil {
+			return err
+		}
+
+		method, _ := grpc.MethodFromServerStream(stream)
+		md, _ := metadata.FromIncomingContext(stream.Context())
+		c.mu.Lock()
+		c.methods = append(c.methods, method)
+		c.headers = append(c.headers, md)
+		c.mu.Unlock()
+
+		return stream.SendMsg(&emptypb.Empty{})
+	}))
+	go func() { _ = c.Serve(lis) }()
+
+	return c
+}
+
+func (c *collectorStub) exports() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]string(nil), c.methods...)
+}
+
+var _ = Describe("Tracing", func() {
+	var collector *collectorStub
+
+	BeforeEach(func() {
+		collector = newCollectorStub()
+	})
+
+	AfterEach(func() {
+		collector.Stop()
+	})
+
+	It("should export the spans to the collector", func() {
+		stop, err := tracing.Start(&tracing.Config{
+			Endpoint: collector.addr,
+			Insecure: true,
+			Headers:  map[string]string{"x-api-key": "secret"},
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		_, span := global.Tracer("test").Start(context.Background(), "test")
+		span.End()
+
+		Expect(stop(context.Background())).To(Succeed())
+		Expect(collector.exports()).To(ContainElement("/opentelemetry.proto.collector.trace.v1.TraceService/Export"))
+		Expect(collector.headers[0].Get("x-api-key")).To(ConsistOf("secret"))
+	})
+
+	It("should refuse a config without endpoint", func() {
+		_, err := tracing.Start(&tracing.Config{})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should only propagate the context when disabled", func() {
+		stop, err := tracing.Start(nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(stop(context.Background())).To(Succeed())
+		Expect(global.TextMapPropagator().Fields()).To(ContainElement("traceparent"))
+	})
+})